@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type AdminStatus struct {
+	Generation  uint64
+	UpdateTime  time.Time
+	DataTime    time.Time
+	Policies    int
+	ExitIPs     int
+	Stale       bool
+	LastSuccess time.Time
+	LastFailure time.Time
+	LastError   string
+	Failures    int
+}
+
+// distinct exit addresses, the list is sorted by address
+func (d *ExitData) CountAddresses() int {
+	n := 0
+	for i, p := range d.List {
+		if i == 0 || p.Address != d.List[i-1].Address {
+			n += 1
+		}
+	}
+	return n
+}
+
+func GetAdminStatus(Exits *Exits) AdminStatus {
+	data := Exits.Current()
+	status := Exits.ReloadStatus()
+	return AdminStatus{
+		Generation:  data.Generation,
+		UpdateTime:  data.UpdateTime,
+		DataTime:    data.DataTime,
+		Policies:    len(data.Policies()),
+		ExitIPs:     data.CountAddresses(),
+		Stale:       data.IsStale(Exits.MaxAge, Exits.clock()),
+		LastSuccess: status.LastSuccess,
+		LastFailure: status.LastFailure,
+		LastError:   status.LastError,
+		Failures:    status.Failures,
+	}
+}
+
+func ReadAdminToken(filePath string) (string, error) {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if len(token) == 0 {
+		return "", fmt.Errorf("%s: empty admin token", filePath)
+	}
+	return token, nil
+}
+
+func isAuthorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func writeAdminStatus(w http.ResponseWriter, code int, status AdminStatus) {
+	b, _ := json.MarshalIndent(status, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// GET /status reports on the loaded data, POST /reload does what SIGUSR2
+// does and then reports
+func AdminHandler(Exits *Exits, token string, reload func() error) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAdminStatus(w, http.StatusOK, GetAdminStatus(Exits))
+	})
+
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		code := http.StatusOK
+		if err := reload(); err != nil {
+			code = http.StatusInternalServerError
+		}
+		writeAdminStatus(w, code, GetAdminStatus(Exits))
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="check admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// listens on host:port or, prefixed with unix:, a socket only we can use
+func ListenAdmin(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	socketPath := strings.TrimPrefix(addr, "unix:")
+	// clean up after a previous run
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method string, target string, token string) (*httptest.ResponseRecorder, AdminStatus) {
+	r := httptest.NewRequest(method, target, nil)
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	var status AdminStatus
+	if w.Header().Get("Content-Type") == "application/json" {
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, status
+}
+
+func TestAdminHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policies := path.Join(dir, "exit-policies")
+
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111", "111.111.111.112"], "Fingerprint": "1"}
+	{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "2"}`
+	if err = ioutil.WriteFile(policies, []byte(testData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exits := new(Exits)
+	if err = exits.Reload(policies, "", false); err != nil {
+		t.Fatal(err)
+	}
+	h := AdminHandler(exits, "secret", func() error {
+		return exits.Reload(policies, "", true)
+	})
+
+	// needs the token
+	for _, token := range []string{"", "wrong", "secret "} {
+		if w, _ := adminRequest(t, h, "GET", "/status", token); w.Code != http.StatusUnauthorized {
+			t.Errorf("Got %d with token %q, expected 401", w.Code, token)
+		}
+	}
+
+	w, status := adminRequest(t, h, "GET", "/status", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got %d", w.Code)
+	}
+	if status.Generation != 1 || status.Policies != 2 || status.ExitIPs != 2 || status.UpdateTime.IsZero() || status.LastSuccess.IsZero() {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	if w, _ = adminRequest(t, h, "GET", "/reload", "secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got %d for GET /reload", w.Code)
+	}
+	if w, _ = adminRequest(t, h, "POST", "/status", "secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got %d for POST /status", w.Code)
+	}
+
+	if w, status = adminRequest(t, h, "POST", "/reload", "secret"); w.Code != http.StatusOK || status.Generation != 2 {
+		t.Errorf("Got %d and %+v reloading", w.Code, status)
+	}
+
+	// failures are reported and the data is kept
+	if err = ioutil.WriteFile(policies, []byte(testData[:20]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, status = adminRequest(t, h, "POST", "/reload", "secret")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Got %d reloading a broken file", w.Code)
+	}
+	if status.Generation != 2 || status.Failures != 1 || len(status.LastError) == 0 || status.LastFailure.IsZero() {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestListenAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "admin.sock")
+
+	// a stale socket is replaced
+	if err = ioutil.WriteFile(socket, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := ListenAdmin("unix:" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("Unexpected socket mode %v", info.Mode())
+	}
+
+	if _, err = ReadAdminToken(path.Join(dir, "missing")); err == nil {
+		t.Error("Expected an error reading a missing token")
+	}
+	token := path.Join(dir, "token")
+	if err = ioutil.WriteFile(token, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := ReadAdminToken(token); s != "secret" || err != nil {
+		t.Errorf("Got %q, %v", s, err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// caps on a single batch request. where the server can't stream, the
+// addresses are all read before answering so the body is capped lower
+const (
+	MaxBatchAddresses     = 100000
+	MaxBatchBytes         = 8 << 20
+	MaxBufferedBatchBytes = 1 << 20
+)
+
+type BatchExit struct {
+	Fingerprint string
+	Tminus      int
+}
+
+type BatchResult struct {
+	IP    string
+	IsTor bool
+	Exits []BatchExit `json:",omitempty"`
+	Error string      `json:",omitempty"`
+}
+
+// reads the addresses one at a time, io.EOF when there are no more
+type addressReader func() (string, error)
+
+// a json array of strings
+func jsonAddresses(r io.Reader) addressReader {
+	dec := json.NewDecoder(r)
+	started := false
+	return func() (string, error) {
+		if !started {
+			started = true
+			t, err := dec.Token()
+			if err != nil {
+				return "", err
+			}
+			if d, ok := t.(json.Delim); !ok || d != '[' {
+				return "", errors.New("expected a json array of addresses")
+			}
+		}
+		if !dec.More() {
+			return "", io.EOF
+		}
+		var addr string
+		if err := dec.Decode(&addr); err != nil {
+			return "", err
+		}
+		return addr, nil
+	}
+}
+
+// one address per line, blank lines skipped
+func textAddresses(r io.Reader) addressReader {
+	scanner := bufio.NewScanner(r)
+	return func() (string, error) {
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); len(line) > 0 {
+				return line, nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+}
+
+// reads all the addresses up front, keeping an error for the end. only
+// used without full duplex, on a body capped at MaxBufferedBatchBytes
+func bufferedAddresses(next addressReader) addressReader {
+	var addrs []string
+	var err error
+	for len(addrs) <= MaxBatchAddresses {
+		var addr string
+		if addr, err = next(); err != nil {
+			break
+		}
+		addrs = append(addrs, addr)
+	}
+	return func() (string, error) {
+		if len(addrs) == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return "", err
+		}
+		addr := addrs[0]
+		addrs = addrs[1:]
+		return addr, nil
+	}
+}
+
+// implemented by the http/1 and http/2 response writers since go 1.21.
+// without it the server stops reading the body once the response is
+// flushed, so older toolchains, and writers that wrap the server's, fall
+// back to bufferedAddresses
+type fullDuplexer interface {
+	EnableFullDuplex() error
+}
+
+func batchResult(data *ExitData, addr string, q url.Values) BatchResult {
+	ip := ParseAddress(addr)
+	if ip == nil {
+		return BatchResult{IP: addr, Error: "invalid address"}
+	}
+	// validated before we started
+	target, _ := apiTarget(q, ip)
+	res := BatchResult{IP: ip.String()}
+	for _, pa := range data.exitsTo(ip, target) {
+		res.Exits = append(res.Exits, BatchExit{pa.Policy.Fingerprint, pa.Tminus})
+	}
+	res.IsTor = len(res.Exits) > 0
+	return res
+}
+
+// POST a json array of addresses, or one per line, and get a json array
+// of results in the same order. where the server can, results are
+// written as the addresses are read so large batches aren't held in
+// memory; a problem part way through ends the array with a result that
+// only has an Error
+func BatchHandler(Exits *Exits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			b, _ := json.Marshal(APIError{"POST a list of addresses"})
+			w.Write(b)
+			return
+		}
+		d, ok := w.(fullDuplexer)
+		streaming := ok && d.EnableFullDuplex() == nil
+		var maxBytes int64 = MaxBatchBytes
+		if !streaming {
+			maxBytes = MaxBufferedBatchBytes
+		}
+		if r.ContentLength > maxBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			b, _ := json.Marshal(APIError{fmt.Sprintf("at most %d bytes", maxBytes)})
+			w.Write(b)
+			return
+		}
+		q := r.URL.Query()
+		if _, err := apiTarget(q, net.IPv4zero); err != nil {
+			writeAPIError(w, err.Error())
+			return
+		}
+
+		body := http.MaxBytesReader(w, r.Body, maxBytes)
+		next := textAddresses(body)
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			next = jsonAddresses(body)
+		}
+		if !streaming {
+			next = bufferedAddresses(next)
+		}
+
+		// one generation of the data for the whole response
+		data := Exits.Current()
+		setStale(w, data.IsStale(Exits.MaxAge, Exits.clock()))
+
+		io.WriteString(w, "[")
+		sep := "\n"
+		write := func(res BatchResult) {
+			b, _ := json.Marshal(res)
+			io.WriteString(w, sep)
+			w.Write(b)
+			sep = ",\n"
+		}
+		for n := 0; ; n++ {
+			addr, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				write(BatchResult{Error: err.Error()})
+				break
+			}
+			if n == MaxBatchAddresses {
+				write(BatchResult{Error: fmt.Sprintf("only the first %d addresses were checked", MaxBatchAddresses)})
+				break
+			}
+			write(batchResult(data, addr, q))
+		}
+		io.WriteString(w, "\n]\n")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const batchTestData = `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1", "Tminus": 2}
+{"Rules": [{"IsAccept": true, "MinPort": 80, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111", "222.222.222.222"], "Fingerprint": "2", "Tminus": 5}`
+
+func postBatch(t *testing.T, h http.Handler, target string, contentType string, body string) (*httptest.ResponseRecorder, []BatchResult) {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var results []BatchResult
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%v in %s", err, w.Body.String())
+		}
+	}
+	return w, results
+}
+
+func TestBatchHandler(t *testing.T) {
+	exits := setupExitList(t, batchTestData)
+	h := BatchHandler(exits)
+
+	expected := []BatchResult{
+		{IP: "111.111.111.111", IsTor: true, Exits: []BatchExit{{"1", 2}, {"2", 5}}},
+		{IP: "1.2.3.4"},
+		{IP: "222.222.222.222", IsTor: true, Exits: []BatchExit{{"2", 5}}},
+		{IP: "nonsense", Error: "invalid address"},
+		{IP: "2001:db8::1"},
+	}
+	inputs := []struct {
+		contentType string
+		body        string
+	}{
+		{"application/json", `["111.111.111.111", "1.2.3.4", "222.222.222.222", "nonsense", "2001:0db8::1"]`},
+		{"application/json; charset=utf-8", `["111.111.111.111","1.2.3.4","222.222.222.222","nonsense","2001:db8::1"]`},
+		{"text/plain", "111.111.111.111\n1.2.3.4\r\n\n  222.222.222.222\nnonsense\n2001:0db8::1"},
+		{"", "111.111.111.111\n1.2.3.4\n222.222.222.222\nnonsense\n2001:db8::1\n"},
+	}
+	for _, x := range inputs {
+		w, results := postBatch(t, h, "/api/ips", x.contentType, x.body)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("Got %d %s for %q", w.Code, w.Header().Get("Content-Type"), x.body)
+		}
+		if fmt.Sprint(results) != fmt.Sprint(expected) {
+			t.Errorf("Got %v for %q, expected %v", results, x.body, expected)
+		}
+	}
+
+	// another target or port
+	_, results := postBatch(t, h, "/api/ips?port=80", "text/plain", "111.111.111.111\n222.222.222.222")
+	if s := fmt.Sprint(results); s != fmt.Sprint([]BatchResult{
+		{IP: "111.111.111.111", IsTor: true, Exits: []BatchExit{{"2", 5}}},
+		{IP: "222.222.222.222", IsTor: true, Exits: []BatchExit{{"2", 5}}},
+	}) {
+		t.Errorf("Got %s", s)
+	}
+
+	// nothing in, nothing out
+	if w, results := postBatch(t, h, "/api/ips", "application/json", `[]`); w.Code != http.StatusOK || len(results) != 0 {
+		t.Errorf("Got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBatchHandlerErrors(t *testing.T) {
+	exits := setupExitList(t, batchTestData)
+	h := BatchHandler(exits)
+
+	if w := serve(h, "/api/ips", "127.0.0.1:1234"); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Errorf("Got %d for a GET", w.Code)
+	}
+	if w, _ := postBatch(t, h, "/api/ips?port=0", "text/plain", "1.2.3.4"); w.Code != http.StatusBadRequest {
+		t.Errorf("Got %d for port 0", w.Code)
+	}
+	if w, _ := postBatch(t, h, "/api/ips", "text/plain", strings.Repeat("1.2.3.4\n", MaxBatchBytes/8+1)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Got %d for too large a body", w.Code)
+	}
+	// the recorder can't stream, so the body is buffered and capped lower
+	if w, _ := postBatch(t, h, "/api/ips", "text/plain", strings.Repeat("1.2.3.4\n", MaxBufferedBatchBytes/8+1)); w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), fmt.Sprint(MaxBufferedBatchBytes)) {
+		t.Errorf("Got %d %s for too large a buffered body", w.Code, w.Body.String())
+	}
+	// and as it's read when the length isn't known
+	line := strings.Repeat(" ", 100) + "1.2.3.4\n"
+	r := httptest.NewRequest("POST", "/api/ips", strings.NewReader(strings.Repeat(line, MaxBufferedBatchBytes/len(line)+1)))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var results []BatchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) == 0 || !strings.Contains(results[len(results)-1].Error, "too large") {
+		t.Errorf("Got %d results, expected them to end with an error over the buffered cap", len(results))
+	}
+
+	// problems part way through end the array
+	tests := []struct {
+		contentType string
+		body        string
+		results     int
+		expected    string
+	}{
+		{"application/json", `{"ips": ["1.2.3.4"]}`, 1, "expected a json array"},
+		{"application/json", `["1.2.3.4", 5]`, 2, "cannot unmarshal number"},
+		{"application/json", `["1.2.3.4", "5.6.7.8"`, 3, "unexpected end"},
+		{"text/plain", strings.Repeat("1.2.3.4\n", MaxBatchAddresses+10), MaxBatchAddresses + 1, fmt.Sprintf("only the first %d", MaxBatchAddresses)},
+	}
+	for _, x := range tests {
+		w, results := postBatch(t, h, "/api/ips", x.contentType, x.body)
+		if w.Code != http.StatusOK || len(results) != x.results {
+			t.Errorf("Got %d with %d results, expected %d", w.Code, len(results), x.results)
+			continue
+		}
+		last := results[len(results)-1]
+		if len(last.IP) > 0 || !strings.Contains(last.Error, x.expected) {
+			t.Errorf("Got %+v, expected an error with %q", last, x.expected)
+		}
+	}
+}
+
+func postBatchServer(t *testing.T, url string, body string, chunked bool) (int, []BatchResult) {
+	var r io.Reader = strings.NewReader(body)
+	if chunked {
+		// hides the length so it's sent chunked
+		r = struct{ io.Reader }{r}
+	}
+	resp, err := http.Post(url, "text/plain", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var results []BatchResult
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, results
+}
+
+// the body is still read after the first results are sent
+func TestBatchHandlerServer(t *testing.T) {
+	exits := setupExitList(t, batchTestData)
+	srv := httptest.NewServer(BatchHandler(exits))
+	defer srv.Close()
+
+	for _, chunked := range []bool{false, true} {
+		// small enough for the server to otherwise discard the rest of it
+		body := strings.Repeat("111.111.111.111\n1.2.3.4\n", 1000)
+		_, results := postBatchServer(t, srv.URL, body, chunked)
+		if len(results) != 2000 || !results[1998].IsTor || len(results[1999].Error) > 0 {
+			t.Errorf("Got %d results ending in %+v", len(results), results[len(results)-1])
+		}
+
+		// capped as it's read
+		body = strings.Repeat(strings.Repeat(" ", 200)+"111.111.111.111\n", MaxBatchBytes/216+1)
+		code, results := postBatchServer(t, srv.URL, body, chunked)
+		if !chunked {
+			if code != http.StatusRequestEntityTooLarge {
+				t.Errorf("Got %d, expected the length to be refused", code)
+			}
+			continue
+		}
+		if len(results) < 2 || !results[0].IsTor || !strings.Contains(results[len(results)-1].Error, "too large") {
+			t.Errorf("Got %d results ending in %+v", len(results), results[len(results)-1])
+		}
+	}
+}
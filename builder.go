@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type builtExit struct {
+	Policy
+	IsAllowed bool
+}
+
+// the exit list written in the same hour as the consensus, like
+// exitips.py we rely on both being named after the time they were
+// fetched (2019-01-01-12-00-00-consensus and 2019-01-01-12-02-01)
+func matchExitList(consensus string, exitLists []string) string {
+	d := strings.TrimSuffix(path.Base(consensus), "-consensus")
+	if len(d) < 13 {
+		return ""
+	}
+	var match string
+	for _, l := range exitLists {
+		if strings.HasPrefix(path.Base(l), d[:13]) {
+			match = l
+		}
+	}
+	return match
+}
+
+// the addresses that aren't of a family TorDNSEL measured, so its ipv4
+// measurements don't replace a relay's ipv6 addresses
+func otherFamily(addrs []string, measured []ExitAddress) []string {
+	var v4, v6 bool
+	for _, a := range measured {
+		if strings.Contains(a.Address, ":") {
+			v6 = true
+		} else {
+			v4 = true
+		}
+	}
+	var kept []string
+	for _, a := range addrs {
+		if isV6 := strings.Contains(a, ":"); (isV6 && !v6) || (!isV6 && !v4) {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// builds the exit policies from the consensuses (newest first), the
+// exit lists and tor's cached-descriptors, the way exitips.py does
+func BuildExitPolicies(consensuses []string, exitLists []string, descriptors string, now time.Time) ([]Policy, error) {
+	exits := make(map[string]*builtExit)
+
+	for _, f := range consensuses {
+		c, err := ParseConsensusFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		// consensus from t hours ago
+		t := HoursSince(c.ValidAfter, now)
+
+		for _, r := range c.Routers {
+			if _, ok := exits[r.Fingerprint]; ok {
+				continue
+			}
+			b := &builtExit{
+				Policy: Policy{
+					Fingerprint:      r.Fingerprint,
+					IsAllowedDefault: r.IsAllowedDefault,
+					Tminus:           t,
+					LastSeen:         c.ValidAfter,
+				},
+				IsAllowed: r.IsExitingAllowed(),
+			}
+			for _, a := range r.Addresses() {
+				b.seeAddress(a, c.ValidAfter)
+			}
+			if b.IsAllowed {
+				b.Rules = r.PolicyRules()
+			}
+			exits[r.Fingerprint] = b
+		}
+
+		l := matchExitList(f, exitLists)
+		if len(l) == 0 {
+			continue
+		}
+		entries, err := ParseExitListFile(l)
+		if err != nil {
+			return nil, err
+		}
+
+		// update exit addresses with data from TorDNSEL, replacing the
+		// published address of routers first seen in this consensus
+		reset := make(map[string]bool)
+		for _, entry := range entries {
+			b, ok := exits[entry.Fingerprint]
+			if !ok {
+				continue
+			}
+			if b.Tminus == t && !reset[entry.Fingerprint] && len(entry.ExitAddresses) > 0 {
+				seen := b.AddressSeen
+				kept := otherFamily(b.Address, entry.ExitAddresses)
+				b.Address, b.AddressSeen = nil, nil
+				for _, a := range kept {
+					b.seeAddress(a, seen[a])
+				}
+				reset[entry.Fingerprint] = true
+			}
+			// each as of when TorDNSEL saw it, so addresses from older
+			// exit lists expire on their own
+			for _, a := range entry.ExitAddresses {
+				b.seeAddress(a.Address, a.Time)
+			}
+		}
+	}
+
+	// update all with the full policies from the latest descriptors
+	if len(descriptors) > 0 {
+		descs, err := ParseServerDescriptorsFile(descriptors)
+		if err != nil {
+			return nil, err
+		}
+		latest := make(map[string]ServerDescriptor)
+		for _, d := range descs {
+			if q, ok := latest[d.Fingerprint]; !ok || !d.Published.Before(q.Published) {
+				latest[d.Fingerprint] = d
+			}
+		}
+		for fingerprint, d := range latest {
+			if b, ok := exits[fingerprint]; ok {
+				b.IsAllowed = d.IsExitingAllowed()
+				if b.IsAllowed {
+					b.Rules = d.Rules()
+				}
+				for _, a := range d.IPv6Addresses() {
+					b.seeAddress(a, b.LastSeen)
+				}
+			}
+		}
+	}
+
+	var policies []Policy
+	for _, b := range exits {
+		if b.IsAllowed {
+			policies = append(policies, b.Policy)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Fingerprint < policies[j].Fingerprint
+	})
+
+	return policies, nil
+}
+
+// writes the JSON lines read by Exits.Load
+func WritePolicies(w io.Writer, policies []Policy) error {
+	enc := json.NewEncoder(w)
+	for _, p := range policies {
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes to a temporary file first so a running server never reads
+// a partial file
+func WritePoliciesToFile(filePath string, policies []Policy) error {
+	return writeFileAtomic(filePath, func(w io.Writer) error {
+		return WritePolicies(w, policies)
+	})
+}
+
+// the files in dir, sorted by name
+func listFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range infos {
+		if !info.IsDir() {
+			files = append(files, path.Join(dir, info.Name()))
+		}
+	}
+	return files, nil
+}
+
+// check build-exits, a replacement for scripts/exitips.py
+func BuildExitsMain(args []string) error {
+	fs := flag.NewFlagSet("build-exits", flag.ExitOnError)
+	basePath := fs.String("base", "./", "path to base dir")
+	consensusDir := fs.String("consensuses", "data/consensuses", "directory of consensuses")
+	exitListDir := fs.String("exit-lists", "data/exit-lists", "directory of TorDNSEL exit lists")
+	descriptorsPath := fs.String("descriptors", "data/cached-descriptors", "file of server descriptors; empty to skip")
+	outPath := fs.String("o", "data/exit-policies", "file to write the exit policies to")
+	limit := fs.Int("n", 0, "only use the latest n consensuses; 0 for all")
+	fs.Parse(args)
+
+	base := func(p string) string {
+		if len(p) == 0 || filepath.IsAbs(p) {
+			return p
+		}
+		return path.Join(*basePath, p)
+	}
+
+	consensuses, err := listFiles(base(*consensusDir))
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(consensuses)))
+	if *limit > 0 && len(consensuses) > *limit {
+		consensuses = consensuses[:*limit]
+	}
+
+	exitLists, err := listFiles(base(*exitListDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	policies, err := BuildExitPolicies(consensuses, exitLists, base(*descriptorsPath), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return WritePoliciesToFile(base(*outPath), policies)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+var testConsensuses = []string{
+	"testdata/consensuses/2019-01-01-12-00-00-consensus",
+	"testdata/consensuses/2019-01-01-11-00-00-consensus",
+}
+
+var testExitLists = []string{
+	"testdata/exit-lists/2019-01-01-11-02-01",
+	"testdata/exit-lists/2019-01-01-12-02-01",
+}
+
+func TestMatchExitList(t *testing.T) {
+	if l := matchExitList(testConsensuses[0], testExitLists); l != testExitLists[1] {
+		t.Errorf("Got %s", l)
+	}
+	if l := matchExitList("data/consensuses/2019-01-01-13-00-00-consensus", testExitLists); l != "" {
+		t.Errorf("Got %s", l)
+	}
+}
+
+func TestBuildExitPolicies(t *testing.T) {
+	now := time.Date(2019, 1, 1, 12, 30, 0, 0, time.UTC)
+	policies, err := BuildExitPolicies(testConsensuses, testExitLists, "testdata/cached-descriptors", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		fingerprint string
+		address     []string
+		rules       int
+		tminus      int
+	}{
+		// exit3, its ipv6 address from the a line, both measured addresses
+		// and the latest descriptor with its accept6 line moved up front, once
+		{"0FDAF05AFE26B9D620AF4186609389B0974FD597", []string{"2001:db8:3::1", "51.15.43.206", "51.15.43.207"}, 5, 0},
+		// exit2, the ipv6-policy adds three rules and its or-address is
+		// in canonical form
+		{"3A2A0416127D286C4D0C5FCD8F96DA7E3CB35D08", []string{"83.227.52.198", "2001:db8:2::1"}, 16, 0},
+		// exit4, only in the older consensus and without a descriptor
+		{"B50EC2A8DF8209C6371981569E8C35918BC03410", []string{"185.220.101.5"}, 3, 1},
+		// exit1, measured addresses from both exit lists
+		{"C1032C7046EF1D28E5D6D3EE402C21B0036EC52F", []string{"91.121.43.81", "91.121.43.79"}, 16, 0},
+	}
+
+	if len(policies) != len(expected) {
+		t.Fatalf("Got %d policies, expected %d", len(policies), len(expected))
+	}
+	for i, x := range expected {
+		p := policies[i]
+		if p.Fingerprint != x.fingerprint {
+			t.Errorf("Got %s, expected %s", p.Fingerprint, x.fingerprint)
+			continue
+		}
+		if len(p.Address) != len(x.address) {
+			t.Errorf("Got addresses %v for %s, expected %v", p.Address, p.Fingerprint, x.address)
+		} else {
+			for j := range x.address {
+				if p.Address[j] != x.address[j] {
+					t.Errorf("Got addresses %v for %s, expected %v", p.Address, p.Fingerprint, x.address)
+				}
+			}
+		}
+		if len(p.Rules) != x.rules {
+			t.Errorf("Got %d rules for %s, expected %d", len(p.Rules), p.Fingerprint, x.rules)
+		}
+		if p.Tminus != x.tminus {
+			t.Errorf("Got tminus %d for %s, expected %d", p.Tminus, p.Fingerprint, x.tminus)
+		}
+	}
+
+	// each address as of when it was last seen there
+	seen := map[string]map[string]time.Time{
+		"C1032C7046EF1D28E5D6D3EE402C21B0036EC52F": {
+			"91.121.43.79": time.Date(2019, 1, 1, 10, 8, 48, 0, time.UTC),
+			"91.121.43.81": time.Date(2019, 1, 1, 11, 8, 48, 0, time.UTC),
+		},
+		"0FDAF05AFE26B9D620AF4186609389B0974FD597": {
+			"2001:db8:3::1": time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC),
+			"51.15.43.206":  time.Date(2018, 12, 30, 9, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, p := range policies {
+		for addr, expected := range seen[p.Fingerprint] {
+			if got := p.AddressSeen[addr]; !got.Equal(expected) {
+				t.Errorf("Got %s seen at %v for %s, expected %v", addr, got, p.Fingerprint, expected)
+			}
+		}
+	}
+
+	// round trip through the format Exits.Load reads
+	buf := new(bytes.Buffer)
+	if err = WritePolicies(buf, policies); err != nil {
+		t.Fatal(err)
+	}
+	exits := &Exits{now: func() time.Time { return now }}
+	if err = exits.Load(buf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	exits.assertIsTor(t, "91.121.43.81", true)
+	exits.assertIsTor(t, "91.121.43.80", false)
+	exits.assertIsTor(t, "185.220.101.5", true)
+	exits.assertIsTor(t, "62.210.92.11", false)
+	// exit3 was last measured there days ago
+	exits.assertIsTor(t, "51.15.43.207", true)
+	exits.assertIsTor(t, "51.15.43.206", false)
+
+	expectDump(t, exits, "38.229.70.31", 80, "91.121.43.79", "91.121.43.81", "83.227.52.198", "185.220.101.5")
+	expectDump(t, exits, "10.0.0.1", 80, "185.220.101.5")
+}
+
+func TestBuildExitsMain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := path.Join(dir, "exit-policies")
+	err = BuildExitsMain([]string{
+		"-base", "testdata",
+		"-consensuses", "consensuses",
+		"-exit-lists", "exit-lists",
+		"-descriptors", "cached-descriptors",
+		"-o", out,
+		"-n", "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// aged as of the latest consensus
+	e := &Exits{now: func() time.Time { return time.Date(2019, 1, 1, 12, 30, 0, 0, time.UTC) }}
+	if err = e.LoadFromFile(out, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// exit4 is only in the older consensus
+	policies := e.Policies()
+	if len(policies) != 3 {
+		t.Errorf("Got %d policies, expected 3", len(policies))
+	}
+	for _, p := range policies {
+		if p.Fingerprint == "B50EC2A8DF8209C6371981569E8C35918BC03410" {
+			t.Error("Didn't expect exit4")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// how many rendered bulk lists each generation of the data keeps
+var BulkCacheSize = 128
+
+type bulkKey struct {
+	IP     string
+	Port   int
+	Tminus int
+	JSON   bool
+}
+
+func newBulkKey(ip string, port int, tminus int, json bool) bulkKey {
+	// so 1.2.3.4 and ::ffff:1.2.3.4 share an entry
+	return bulkKey{CanonicalIP(ip), port, tminus, json}
+}
+
+type bulkEntry struct {
+	key  bulkKey
+	body []byte
+}
+
+// a least recently used cache of rendered bulk lists. it belongs to a
+// generation of the data, so a reload starts with an empty one
+type bulkCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[bulkKey]*list.Element
+}
+
+func newBulkCache(size int) *bulkCache {
+	return &bulkCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[bulkKey]*list.Element),
+	}
+}
+
+func (c *bulkCache) Get(key bulkKey) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*bulkEntry).body, true
+}
+
+func (c *bulkCache) Put(key bulkKey, body []byte) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*bulkEntry).body = body
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&bulkEntry{key, body})
+	for c.order.Len() > c.size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*bulkEntry).key)
+	}
+}
+
+func (c *bulkCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
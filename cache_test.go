@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBulkCache(t *testing.T) {
+	c := newBulkCache(2)
+	a, b, d := newBulkKey("1.2.3.4", 80, 16, false), newBulkKey("1.2.3.4", 443, 16, false), newBulkKey("1.2.3.4", 80, 16, true)
+	c.Put(a, []byte("a"))
+	c.Put(b, []byte("b"))
+
+	// a is now the most recently used, so b goes
+	if body, ok := c.Get(newBulkKey("::ffff:1.2.3.4", 80, 16, false)); !ok || string(body) != "a" {
+		t.Errorf("Got %q, %v", body, ok)
+	}
+	c.Put(d, []byte("d"))
+	if _, ok := c.Get(b); ok {
+		t.Error("Expected b to be evicted")
+	}
+	if _, ok := c.Get(a); !ok {
+		t.Error("Expected a to be kept")
+	}
+	if c.Len() != 2 {
+		t.Errorf("Got %d entries, expected 2", c.Len())
+	}
+
+	// no cache, or a zero sized one, never hits
+	var none *bulkCache
+	none.Put(a, []byte("a"))
+	if _, ok := none.Get(a); ok {
+		t.Error("Got a hit from a nil cache")
+	}
+	zero := newBulkCache(0)
+	zero.Put(a, []byte("a"))
+	if _, ok := zero.Get(a); ok {
+		t.Error("Got a hit from a zero sized cache")
+	}
+}
+
+func TestBulkCacheReload(t *testing.T) {
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1"}`
+	exits := setupExitList(t, testData)
+
+	d := exits.Current()
+	expectDump(t, exits, "38.229.70.31", 443, "111.111.111.111")
+	expectDump(t, exits, "38.229.70.31", 443, "111.111.111.111")
+	if n := d.bulk.Len(); n != 1 {
+		t.Errorf("Got %d cached lists, expected 1", n)
+	}
+
+	// a reload isn't answered from the old generation's cache
+	updated := strings.Replace(testData, "111.111.111.111", "222.222.222.222", 1)
+	if err := exits.Load(strings.NewReader(updated), false); err != nil {
+		t.Fatal(err)
+	}
+	expectDump(t, exits, "38.229.70.31", 443, "222.222.222.222")
+	if n := exits.Current().bulk.Len(); n != 1 {
+		t.Errorf("Got %d cached lists, expected 1", n)
+	}
+}
+
+func TestBulkCacheConcurrent(t *testing.T) {
+	d := syntheticExits(200).Current()
+	expected := make(map[int]string)
+	for port := 0; port < 8; port++ {
+		buf := new(bytes.Buffer)
+		d.dumpJSON(buf, 16, "38.229.70.31", port*100)
+		expected[port*100] = buf.String()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := new(bytes.Buffer)
+			for j := 0; j < 200; j++ {
+				port := (j % 8) * 100
+				buf.Reset()
+				d.DumpJSON(buf, 16, "38.229.70.31", port)
+				if buf.String() != expected[port] {
+					errs <- fmt.Errorf("wrong list for port %d", port)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
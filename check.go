@@ -1,72 +1,235 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
-	"fmt"
 	"github.com/samuel/go-gettext/gettext"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
+	"time"
 )
 
 func main() {
 
-	// command line args
-	logPath := flag.String("log", "", "path to log file; otherwise stdout")
-	pidPath := flag.String("pid", "./check.pid", "path to create pid")
-	basePath := flag.String("base", "./", "path to base dir")
-	port := flag.Int("port", 8000, "port to listen on")
-	flag.Parse()
+	// subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "build-exits":
+			if err := BuildExitsMain(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "diff-exits":
+			code, err := DiffExitsMain(os.Args[2:], os.Stdout)
+			if err != nil {
+				log.Print(err)
+			}
+			os.Exit(code)
+		}
+	}
+
+	// command line args, on top of the config file and environment
+	cfg, printConfig, err := LoadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		if err = cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err = cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		return
+	}
 
-	// log to file
-	if len(*logPath) > 0 {
-		f, err := os.Create(*logPath)
+	TrustedProxies = MustParseCIDRList(cfg.TrustedProxies)
+	ForwardedHeader, _ = ParseForwardedHeader(cfg.ForwardedHeader)
+	upstreams := MustParseCIDRList(cfg.ProxyProtocol)
+	DefaultTarget, DefaultTarget6, _ = cfg.Targets()
+	DefaultTminus = cfg.Tminus
+	MaxTminus = cfg.MaxTminus
+	limits := cfg.ServerLimits()
+
+	// log to file, appended to so an upgrade doesn't truncate the log
+	// the previous process is still writing
+	if len(cfg.Log) > 0 {
+		f, err := os.OpenFile(cfg.Log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
 			log.Fatal(err)
 		}
 		log.SetOutput(f)
 	}
 
-	// write pid
-	pid, err := os.Create(*pidPath)
-	if err != nil {
+	// write pid, removed again on shutdown
+	if err = WritePid(cfg.Pid); err != nil {
 		log.Fatal(err)
 	}
-	if _, err = fmt.Fprintf(pid, "%d\n", os.Getpid()); err != nil {
+
+	// load i18n
+	domain, err := gettext.NewDomain("check", path.Join(cfg.Base, "locale"))
+	if err != nil {
 		log.Fatal(err)
 	}
-	if err = pid.Close(); err != nil {
+	Locales := GetLocaleList(cfg.Base)
+
+	// Load Tor exits and listen for SIGUSR2 to reload
+	exits := &Exits{MaxAge: time.Duration(cfg.MaxAge), SnapshotPath: cfg.Snapshot}
+	if len(cfg.History) > 0 {
+		if exits.History, err = LoadHistory(cfg.History); err != nil {
+			log.Fatal(err)
+		}
+		exits.History.Retention = time.Duration(cfg.HistoryRetention)
+	}
+	exitPolicies := path.Join(cfg.Base, "data/exit-policies")
+	if err = exits.Run(exitPolicies, cfg.ExitAddresses); err != nil {
 		log.Fatal(err)
 	}
+	if cfg.Watch > 0 {
+		go exits.Watch(exitPolicies, cfg.ExitAddresses, time.Duration(cfg.Watch), nil)
+	}
 
-	// load i18n
-	domain, err := gettext.NewDomain("check", path.Join(*basePath, "locale"))
+	// the sockets systemd or the process we're taking over from passed
+	// us, if there are any, and the ones we hand over as they are on
+	// upgrade
+	inherited, err := InheritedListeners()
 	if err != nil {
 		log.Fatal(err)
 	}
-	Locales := GetLocaleList(*basePath)
+	raw := make(map[string]net.Listener)
 
-	// Load Tor exits and listen for SIGUSR2 to reload
-	exits := new(Exits)
-	exits.Run(path.Join(*basePath, "data/exit-policies"))
+	// admin endpoint
+	if len(cfg.Admin) > 0 {
+		token, err := ReadAdminToken(cfg.AdminTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, ok := inherited[listenerAdmin]
+		if !ok {
+			if l, err = ListenAdmin(cfg.Admin); err != nil {
+				log.Fatal(err)
+			}
+		}
+		raw[listenerAdmin] = l
+		admin := AdminHandler(exits, token, func() error {
+			err := exits.Reload(exitPolicies, cfg.ExitAddresses, true)
+			if err != nil {
+				log.Printf("Admin reload failed, keeping the previous exit list: %v", err)
+			}
+			return err
+		})
+		log.Printf("Admin listening on: %s\n", cfg.Admin)
+		go func() {
+			log.Printf("Admin endpoint stopped: %v", http.Serve(l, admin))
+		}()
+	}
 
 	// files
-	files := http.FileServer(http.Dir(path.Join(*basePath, "public")))
+	files := http.FileServer(http.Dir(path.Join(cfg.Base, "public")))
 	Phttp := http.NewServeMux()
 	Phttp.Handle("/torcheck/", http.StripPrefix("/torcheck/", files))
 	Phttp.Handle("/", files)
 
 	// routes
-	http.HandleFunc("/", RootHandler(CompileTemplate(*basePath, domain, "index.html"), exits, domain, Phttp, Locales))
-	bulk := BulkHandler(CompileTemplate(*basePath, domain, "bulk.html"), exits, domain)
-	http.HandleFunc("/torbulkexitlist", bulk)
-	http.HandleFunc("/cgi-bin/TorBulkExitList.py", bulk)
-	http.HandleFunc("/api/bulk", bulk)
-	http.HandleFunc("/api/ip", APIHandler(exits))
+	http.HandleFunc("/", RootHandler(CompileTemplate(cfg.Base, domain, "index.html"), exits, domain, Phttp, Locales))
+	if cfg.Bulk {
+		bulk := BulkHandler(CompileTemplate(cfg.Base, domain, "bulk.html"), exits, domain)
+		http.HandleFunc("/torbulkexitlist", bulk)
+		http.HandleFunc("/cgi-bin/TorBulkExitList.py", bulk)
+		http.HandleFunc("/api/bulk", bulk)
+	}
+	if cfg.API {
+		http.HandleFunc("/api/ip", APIHandler(exits))
+		http.HandleFunc("/api/ips", BatchHandler(exits))
+	}
+	http.HandleFunc("/health", HealthHandler(exits))
 
 	// start the server
-	log.Printf("Listening on port: %d\n", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	l, ok := inherited[listenerHTTP]
+	if ok {
+		log.Printf("Using inherited listener: %s\n", l.Addr())
+	} else if l, err = net.Listen("tcp", cfg.ListenAddr()); err != nil {
+		log.Fatal(err)
+	}
+	raw[listenerHTTP] = l
+
+	servers := []*http.Server{limits.Server(nil)}
+	l = limits.Listener(l)
+	if upstreams.Len() > 0 {
+		l = &ProxyListener{Listener: l, Upstream: upstreams}
+	}
+	if len(cfg.TLSCert) > 0 {
+		certs, err := NewCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		certs.Run()
+		go certs.Watch(time.Minute, nil)
+		l = tls.NewListener(l, certs.TLSConfig())
+
+		if len(cfg.HTTPRedirect) > 0 {
+			rl, ok := inherited[listenerRedirect]
+			if !ok {
+				if rl, err = net.Listen("tcp", cfg.HTTPRedirect); err != nil {
+					log.Fatal(err)
+				}
+			}
+			raw[listenerRedirect] = rl
+			rl = limits.Listener(rl)
+			redirect := limits.Server(RedirectHandler(cfg.Port))
+			servers = append(servers, redirect)
+			log.Printf("Redirecting HTTP on: %s\n", cfg.HTTPRedirect)
+			go serveUntilClosed(redirect, rl)
+		}
+	}
+	log.Printf("Listening on: %s\n", cfg.ListenAddr())
+	go serveUntilClosed(servers[0], l)
+	if err = TakeOver(); err != nil {
+		log.Printf("Stopping the previous process failed: %v", err)
+	}
 
+	// SIGTERM or SIGINT drain and stop, SIGUSR1 starts the new binary on
+	// our listeners and we stop once it's serving
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1)
+	for s := range sig {
+		if s != syscall.SIGUSR1 {
+			log.Printf("Got %v, shutting down.", s)
+			break
+		}
+		p, err := Upgrade(raw)
+		if err != nil {
+			log.Printf("Upgrade failed, carrying on: %v", err)
+			continue
+		}
+		log.Printf("Upgrading, started pid %d.", p.Pid)
+		go func() {
+			// reaped, and we carry on if it never took over
+			state, err := p.Wait()
+			log.Printf("Upgrade pid %d exited: %v %v", p.Pid, state, err)
+		}()
+	}
+	if err = Drain(time.Duration(cfg.ShutdownTimeout), servers...); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	if err = RemovePid(cfg.Pid); err != nil {
+		log.Printf("Removing the pid file: %v", err)
+	}
+
+}
+
+// ErrServerClosed is the graceful shutdown
+func serveUntilClosed(srv *http.Server, l net.Listener) {
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
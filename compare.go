@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// a canonical form of the rule so that exitips.py's expanded ipv6
+// addresses compare equal to ours
+func (r Rule) String() string {
+	action := "reject"
+	if r.IsAccept {
+		action = "accept"
+	}
+	addr := "*"
+	if !r.IsAddressWildcard {
+		switch {
+		case r.IPNet != nil:
+			addr = r.IPNet.String()
+		case r.IP != nil:
+			addr = r.IP.String()
+		default:
+			addr = r.Address
+		}
+	}
+	return fmt.Sprintf("%s %s:%d-%d", action, addr, r.MinPort, r.MaxPort)
+}
+
+func canonicalAddresses(addrs []string) []string {
+	seen := make(map[string]bool)
+	var canon []string
+	for _, a := range addrs {
+		a = CanonicalIP(a)
+		if !seen[a] {
+			seen[a] = true
+			canon = append(canon, a)
+		}
+	}
+	sort.Strings(canon)
+	return canon
+}
+
+// elements of a that aren't in b
+func missingFrom(a []string, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, x := range b {
+		in[x] = true
+	}
+	var missing []string
+	for _, x := range a {
+		if !in[x] {
+			missing = append(missing, x)
+		}
+	}
+	return missing
+}
+
+// a line diff of the rules, based on their longest common subsequence
+func diffRules(a []Rule, b []Rule) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i].String() == b[j].String() {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i].String() == b[j].String():
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, fmt.Sprintf("-%d %s", i, a[i]))
+			i += 1
+		default:
+			lines = append(lines, fmt.Sprintf("+%d %s", j, b[j]))
+			j += 1
+		}
+	}
+	return lines
+}
+
+func policyMap(e *Exits) map[string]Policy {
+	m := make(map[string]Policy)
+	for _, p := range e.Policies() {
+		m[p.Fingerprint] = p
+	}
+	return m
+}
+
+func comparePolicies(a Policy, b Policy) (diffs []string) {
+	aAddrs, bAddrs := canonicalAddresses(a.Address), canonicalAddresses(b.Address)
+	for _, x := range missingFrom(aAddrs, bAddrs) {
+		diffs = append(diffs, "address -"+x)
+	}
+	for _, x := range missingFrom(bAddrs, aAddrs) {
+		diffs = append(diffs, "address +"+x)
+	}
+	for _, line := range diffRules(a.Rules, b.Rules) {
+		diffs = append(diffs, "rule "+line)
+	}
+	if a.IsAllowedDefault != b.IsAllowedDefault {
+		diffs = append(diffs, fmt.Sprintf("IsAllowedDefault %v -> %v", a.IsAllowedDefault, b.IsAllowedDefault))
+	}
+	if a.Tminus != b.Tminus {
+		diffs = append(diffs, fmt.Sprintf("Tminus %d -> %d", a.Tminus, b.Tminus))
+	}
+	return
+}
+
+// writes the differences between two loaded exit lists to w and returns
+// how many fingerprints and IsTor lookups differ
+func CompareExits(w io.Writer, a *Exits, b *Exits) int {
+	aPolicies, bPolicies := policyMap(a), policyMap(b)
+
+	var fingerprints []string
+	for fingerprint := range aPolicies {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	for fingerprint := range bPolicies {
+		if _, ok := aPolicies[fingerprint]; !ok {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+	sort.Strings(fingerprints)
+
+	var onlyA, onlyB, changed int
+	for _, fingerprint := range fingerprints {
+		p, inA := aPolicies[fingerprint]
+		q, inB := bPolicies[fingerprint]
+		switch {
+		case !inB:
+			onlyA += 1
+			fmt.Fprintf(w, "%s: only in old (%s)\n", fingerprint, strings.Join(p.Address, ", "))
+		case !inA:
+			onlyB += 1
+			fmt.Fprintf(w, "%s: only in new (%s)\n", fingerprint, strings.Join(q.Address, ", "))
+		default:
+			diffs := comparePolicies(p, q)
+			if len(diffs) > 0 {
+				changed += 1
+			}
+			for _, d := range diffs {
+				fmt.Fprintf(w, "%s: %s\n", fingerprint, d)
+			}
+		}
+	}
+
+	// how the answers to IsTor change
+	aTor := canonicalAddresses(a.Current().TorAddresses())
+	bTor := canonicalAddresses(b.Current().TorAddresses())
+	lost, gained := missingFrom(aTor, bTor), missingFrom(bTor, aTor)
+	for _, ip := range lost {
+		fmt.Fprintf(w, "IsTor %s: true -> false\n", ip)
+	}
+	for _, ip := range gained {
+		fmt.Fprintf(w, "IsTor %s: false -> true\n", ip)
+	}
+
+	fmt.Fprintf(w, "%d policies in old, %d in new: %d only in old, %d only in new, %d changed\n",
+		len(aPolicies), len(bPolicies), onlyA, onlyB, changed)
+	fmt.Fprintf(w, "IsTor for %s:%d and [%s]:%d: %d addresses in old, %d in new, %d lost, %d gained\n",
+		DefaultTarget.Address, DefaultTarget.Port, DefaultTarget6.Address, DefaultTarget6.Port,
+		len(aTor), len(bTor), len(lost), len(gained))
+
+	return onlyA + onlyB + changed + len(lost) + len(gained)
+}
+
+// as it was written, however long ago that was
+func loadExitsFile(filePath string) (*Exits, error) {
+	e := &Exits{AsWritten: true}
+	if err := e.LoadFromFile(filePath, false); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// check diff-exits, exits non-zero if the files differ
+func DiffExitsMain(args []string, w io.Writer) (int, error) {
+	fs := flag.NewFlagSet("diff-exits", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff-exits <old exit-policies> <new exit-policies>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2, nil
+	}
+
+	a, err := loadExitsFile(fs.Arg(0))
+	if err != nil {
+		return 2, err
+	}
+	b, err := loadExitsFile(fs.Arg(1))
+	if err != nil {
+		return 2, err
+	}
+
+	if CompareExits(w, a, b) > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+var compareOld = `{"Rules": [{"IsAccept": false, "MinPort": 1, "MaxPort": 65535, "Address": "0.0.0.0", "Mask": "255.0.0.0"}, {"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": "", "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1"}
+{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": "2001:0db8:0000:0000:0000:0000:0000:0000", "Mask": "FFFF:FFFF:0000:0000:0000:0000:0000:0000"}], "IsAllowedDefault": false, "Address": ["222.222.222.222"], "Fingerprint": "2"}
+{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": "", "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["33.33.33.33"], "Fingerprint": "3", "Tminus": 2}`
+
+func compareOutput(t *testing.T, older string, newer string) (string, int) {
+	buf := new(bytes.Buffer)
+	n := CompareExits(buf, setupExitList(t, older), setupExitList(t, newer))
+	return buf.String(), n
+}
+
+func TestCompareExitsIdentical(t *testing.T) {
+	// ipv6 rules written by stem are expanded
+	newer := strings.Replace(compareOld, `"2001:0db8:0000:0000:0000:0000:0000:0000", "Mask": "FFFF:FFFF:0000:0000:0000:0000:0000:0000"`, `"2001:db8::", "Mask": "ffff:ffff::"`, 1)
+	out, n := compareOutput(t, compareOld, newer)
+	if n != 0 {
+		t.Errorf("Expected no differences, got %d:\n%s", n, out)
+	}
+}
+
+func TestCompareExits(t *testing.T) {
+	newer := `{"Rules": [{"IsAccept": false, "MinPort": 1, "MaxPort": 65535, "Address": "0.0.0.0", "Mask": "255.0.0.0"}, {"IsAccept": true, "MinPort": 80, "MaxPort": 80, "Address": "", "IsAddressWildcard": true}, {"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": "", "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.112"], "Fingerprint": "1"}
+{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": "2001:db8::", "Mask": "ffff:ffff::"}], "IsAllowedDefault": true, "Address": ["222.222.222.222"], "Fingerprint": "2"}
+{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": "", "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["44.44.44.44"], "Fingerprint": "4"}`
+
+	out, n := compareOutput(t, compareOld, newer)
+
+	expected := []string{
+		"1: address -111.111.111.111",
+		"1: address +111.111.111.112",
+		"1: rule +1 accept *:80-80",
+		"2: IsAllowedDefault false -> true",
+		"3: only in old (33.33.33.33)",
+		"4: only in new (44.44.44.44)",
+		"IsTor 111.111.111.111: true -> false",
+		"IsTor 33.33.33.33: true -> false",
+		"IsTor 111.111.111.112: false -> true",
+		"IsTor 222.222.222.222: false -> true",
+		"IsTor 44.44.44.44: false -> true",
+		"3 policies in old, 3 in new: 1 only in old, 1 only in new, 2 changed",
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != len(expected)+1 {
+		t.Errorf("Got %d lines, expected %d:\n%s", len(lines), len(expected)+1, out)
+	}
+	for _, x := range expected {
+		if !strings.Contains(out, x+"\n") {
+			t.Errorf("Missing %q from:\n%s", x, out)
+		}
+	}
+	if n != 9 {
+		t.Errorf("Got %d differences, expected 9", n)
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	a := []Rule{
+		{IsAccept: false, IsAddressWildcard: true, MinPort: 25, MaxPort: 25},
+		{IsAccept: true, IsAddressWildcard: true, MinPort: 80, MaxPort: 80},
+		{IsAccept: false, IsAddressWildcard: true, MinPort: 1, MaxPort: 65535},
+	}
+	b := []Rule{
+		{IsAccept: true, IsAddressWildcard: true, MinPort: 80, MaxPort: 80},
+		{IsAccept: true, IsAddressWildcard: true, MinPort: 443, MaxPort: 443},
+		{IsAccept: false, IsAddressWildcard: true, MinPort: 1, MaxPort: 65535},
+	}
+	lines := diffRules(a, b)
+	expected := []string{"-0 reject *:25-25", "+1 accept *:443-443"}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Got %v, expected %v", lines, expected)
+	}
+}
+
+func TestDiffExitsMain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	older, newer := path.Join(dir, "old"), path.Join(dir, "new")
+	if err = ioutil.WriteFile(older, []byte(compareOld), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(newer, []byte(compareOld), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if code, err := DiffExitsMain([]string{older, newer}, buf); code != 0 || err != nil {
+		t.Errorf("Got %d, %v for identical files", code, err)
+	}
+
+	if err = ioutil.WriteFile(newer, []byte(strings.Replace(compareOld, `"Tminus": 2`, `"Tminus": 3`, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if code, err := DiffExitsMain([]string{older, newer}, buf); code != 1 || err != nil {
+		t.Errorf("Got %d, %v for different files", code, err)
+	}
+	if !strings.Contains(buf.String(), "3: Tminus 2 -> 3\n") {
+		t.Errorf("Unexpected output:\n%s", buf)
+	}
+
+	if code, err := DiffExitsMain([]string{older, path.Join(dir, "missing")}, buf); code != 2 || err == nil {
+		t.Errorf("Got %d, %v for a missing file", code, err)
+	}
+}
+
+// exit lists built long ago are compared as they were written, whether
+// or not they have LastSeen
+func TestDiffExitsMainOldFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	build := func(out string, n string) {
+		err := BuildExitsMain([]string{
+			"-base", "testdata",
+			"-consensuses", "consensuses",
+			"-exit-lists", "exit-lists",
+			"-descriptors", "cached-descriptors",
+			"-o", out,
+			"-n", n,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	older, newer, latest := path.Join(dir, "old"), path.Join(dir, "new"), path.Join(dir, "latest")
+	build(newer, "0")
+	build(latest, "1")
+
+	// as written before LastSeen was
+	file, err := os.Open(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := ParsePolicies(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range policies {
+		if policies[i].LastSeen.IsZero() {
+			t.Fatalf("Expected %s to have been written with LastSeen", policies[i].Fingerprint)
+		}
+		policies[i].LastSeen = time.Time{}
+	}
+	if err = WritePoliciesToFile(older, policies); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if code, err := DiffExitsMain([]string{older, newer}, buf); code != 0 || err != nil {
+		t.Errorf("Got %d, %v for the same exits:\n%s", code, err, buf)
+	}
+	if !strings.Contains(buf.String(), "4 policies in old, 4 in new") {
+		t.Errorf("Unexpected output:\n%s", buf)
+	}
+
+	// exit4 is only in the older consensus
+	buf.Reset()
+	if code, err := DiffExitsMain([]string{newer, latest}, buf); code != 1 || err != nil {
+		t.Errorf("Got %d, %v for different exits:\n%s", code, err, buf)
+	}
+	if !strings.Contains(buf.String(), "B50EC2A8DF8209C6371981569E8C35918BC03410: only in old") {
+		t.Errorf("Unexpected output:\n%s", buf)
+	}
+}
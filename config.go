@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a time.Duration that reads and prints as "3h" in json and flags
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"90s\" or \"3h\"")
+	}
+	return d.Set(s)
+}
+
+// every setting has one name: the flag, the key in the config file and,
+// upper cased with a CHECK_ prefix, the environment variable. flags set
+// on the command line win over the environment, which wins over the file
+type Config struct {
+	Log              string   `json:"log"`
+	Pid              string   `json:"pid"`
+	Base             string   `json:"base"`
+	Host             string   `json:"host"`
+	Port             int      `json:"port"`
+	ExitAddresses    string   `json:"exit-addresses"`
+	Watch            Duration `json:"watch"`
+	MaxAge           Duration `json:"max-age"`
+	Tminus           int      `json:"tminus"`
+	MaxTminus        int      `json:"max-tminus"`
+	DefaultTarget    string   `json:"default-target"`
+	DefaultTarget6   string   `json:"default-target6"`
+	History          string   `json:"history"`
+	HistoryRetention Duration `json:"history-retention"`
+	Snapshot         string   `json:"snapshot"`
+
+	Admin          string `json:"admin"`
+	AdminTokenFile string `json:"admin-token-file"`
+
+	TrustedProxies  string `json:"trusted-proxies"`
+	ForwardedHeader string `json:"forwarded-header"`
+	ProxyProtocol   string `json:"proxy-protocol"`
+
+	TLSCert      string `json:"tls-cert"`
+	TLSKey       string `json:"tls-key"`
+	HTTPRedirect string `json:"http-redirect"`
+
+	ShutdownTimeout   Duration `json:"shutdown-timeout"`
+	ReadHeaderTimeout Duration `json:"read-header-timeout"`
+	ReadTimeout       Duration `json:"read-timeout"`
+	WriteTimeout      Duration `json:"write-timeout"`
+	IdleTimeout       Duration `json:"idle-timeout"`
+	MaxHeaderBytes    int      `json:"max-header-bytes"`
+	MaxConns          int      `json:"max-conns"`
+
+	// endpoints that can be turned off
+	Bulk bool `json:"bulk"`
+	API  bool `json:"api"`
+}
+
+func DefaultConfig() *Config {
+	limits := DefaultServerLimits
+	return &Config{
+		Pid:               "./check.pid",
+		Base:              "./",
+		Port:              8000,
+		MaxAge:            Duration(3 * time.Hour),
+		Tminus:            DefaultTminus,
+		MaxTminus:         MaxTminus,
+		DefaultTarget:     joinAddressPort(DefaultTarget),
+		DefaultTarget6:    joinAddressPort(DefaultTarget6),
+		HistoryRetention:  Duration(DefaultHistoryRetention),
+		TrustedProxies:    DefaultTrustedProxies,
+		ForwardedHeader:   DefaultForwardedHeader,
+		ShutdownTimeout:   Duration(DefaultShutdownTimeout),
+		ReadHeaderTimeout: Duration(limits.ReadHeaderTimeout),
+		ReadTimeout:       Duration(limits.ReadTimeout),
+		WriteTimeout:      Duration(limits.WriteTimeout),
+		IdleTimeout:       Duration(limits.IdleTimeout),
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
+		MaxConns:          limits.MaxConns,
+		Bulk:              true,
+		API:               true,
+	}
+}
+
+// binds the flags to c
+func (c *Config) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Log, "log", c.Log, "path to log file; otherwise stdout")
+	fs.StringVar(&c.Pid, "pid", c.Pid, "path to create pid")
+	fs.StringVar(&c.Base, "base", c.Base, "path to base dir")
+	fs.StringVar(&c.Host, "host", c.Host, "address to listen on; all of them if empty")
+	fs.IntVar(&c.Port, "port", c.Port, "port to listen on")
+	fs.StringVar(&c.ExitAddresses, "exit-addresses", c.ExitAddresses, "path to TorDNSEL's exit-addresses; otherwise only published addresses are used")
+	fs.Var(&c.Watch, "watch", "poll the exit list files this often and reload when they change; 0 to only reload on SIGUSR2")
+	fs.Var(&c.MaxAge, "max-age", "report the exit list as stale once it is older than this; 0 to never")
+	fs.IntVar(&c.Tminus, "tminus", c.Tminus, "hours an exit is still counted for after it was last seen, and the bulk list's default n")
+	fs.IntVar(&c.MaxTminus, "max-tminus", c.MaxTminus, "hours after an exit was last seen that it's forgotten, the most the bulk list's n can look back")
+	fs.StringVar(&c.DefaultTarget, "default-target", c.DefaultTarget, "address:port IsTor checks whether an exit can reach")
+	fs.StringVar(&c.DefaultTarget6, "default-target6", c.DefaultTarget6, "[address]:port IsTor checks for users connecting over ipv6")
+	fs.StringVar(&c.History, "history", c.History, "path to keep when each exit was seen at each address in, for ?at= lookups; disabled if empty")
+	fs.Var(&c.HistoryRetention, "history-retention", "forget sightings in -history older than this; 0 to keep them all")
+	fs.StringVar(&c.Snapshot, "snapshot", c.Snapshot, "path to save the merged exit list to on every reload and restore it from on startup; disabled if empty")
+	fs.StringVar(&c.Admin, "admin", c.Admin, "address (host:port or unix:/path) for the admin endpoint; disabled if empty")
+	fs.StringVar(&c.AdminTokenFile, "admin-token-file", c.AdminTokenFile, "path to the bearer token required by the admin endpoint")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", c.TrustedProxies, "comma separated addresses and CIDRs of the proxies whose -forwarded-header is believed")
+	fs.StringVar(&c.ForwardedHeader, "forwarded-header", c.ForwardedHeader, "the header -trusted-proxies set the client address in: X-Forwarded-For, Forwarded or X-Real-IP; the others are ignored")
+	fs.StringVar(&c.ProxyProtocol, "proxy-protocol", c.ProxyProtocol, "comma separated addresses and CIDRs of load balancers that send a PROXY protocol header; disabled if empty")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "path to a PEM certificate (chain) to serve HTTPS on -port; reloaded on SIGHUP or when it changes")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "path to the PEM key for -tls-cert")
+	fs.StringVar(&c.HTTPRedirect, "http-redirect", c.HTTPRedirect, "address (e.g. :80) to redirect plain HTTP to HTTPS from; needs -tls-cert")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout", "how long in-flight requests get to finish on SIGTERM or SIGINT")
+	fs.Var(&c.ReadHeaderTimeout, "read-header-timeout", "how long a client gets to send the request headers")
+	fs.Var(&c.ReadTimeout, "read-timeout", "how long a client gets to send the whole request")
+	fs.Var(&c.WriteTimeout, "write-timeout", "how long writing a response may take")
+	fs.Var(&c.IdleTimeout, "idle-timeout", "how long a keep-alive connection may sit idle")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", c.MaxHeaderBytes, "largest request headers accepted")
+	fs.IntVar(&c.MaxConns, "max-conns", c.MaxConns, "most connections open at once, the rest wait to be accepted; 0 for no cap")
+	fs.BoolVar(&c.Bulk, "bulk", c.Bulk, "serve the bulk exit list")
+	fs.BoolVar(&c.API, "api", c.API, "serve /api/ip")
+}
+
+// the environment variable for a flag, e.g. CHECK_MAX_AGE for -max-age
+func envName(flagName string) string {
+	return "CHECK_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// parses args, as main's flags, on top of the config file (-config or
+// CHECK_CONFIG) and the environment. printConfig is -print-config
+func LoadConfig(args []string, getenv func(string) string) (c *Config, printConfig bool, err error) {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fromArgs := DefaultConfig()
+	fromArgs.Flags(fs)
+	configPath := fs.String("config", getenv("CHECK_CONFIG"), "path to a JSON config file")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective config as JSON and exit")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+
+	c = DefaultConfig()
+	if len(*configPath) > 0 {
+		if err = c.readFile(*configPath); err != nil {
+			return
+		}
+	}
+
+	// the file and environment first, then what's on the command line
+	cfs := flag.NewFlagSet("check", flag.ContinueOnError)
+	c.Flags(cfs)
+	cfs.VisitAll(func(f *flag.Flag) {
+		if v := getenv(envName(f.Name)); len(v) > 0 && err == nil {
+			if e := cfs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), e)
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if cfs.Lookup(f.Name) != nil {
+			cfs.Set(f.Name, f.Value.String())
+		}
+	})
+	return
+}
+
+func (c *Config) readFile(configPath string) error {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	// typos shouldn't be silently ignored
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %v", configPath, err)
+	}
+	return nil
+}
+
+func (c *Config) Print(w io.Writer) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+func joinAddressPort(ap AddressPort) string {
+	return net.JoinHostPort(ap.Address, strconv.Itoa(ap.Port))
+}
+
+// host:port, where the host is an address of the family
+func parseTarget(s string, ipv6 bool) (AddressPort, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return AddressPort{}, err
+	}
+	ip := ParseAddress(host)
+	if ip == nil || isIPv6(ip) != ipv6 {
+		family := "ipv4"
+		if ipv6 {
+			family = "ipv6"
+		}
+		return AddressPort{}, fmt.Errorf("%q isn't an %s address", host, family)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return AddressPort{}, fmt.Errorf("invalid port %q", port)
+	}
+	return AddressPort{ip.String(), p}, nil
+}
+
+func (c *Config) Targets() (target AddressPort, target6 AddressPort, err error) {
+	if target, err = parseTarget(c.DefaultTarget, false); err != nil {
+		return
+	}
+	target6, err = parseTarget(c.DefaultTarget6, true)
+	return
+}
+
+func (c *Config) ServerLimits() ServerLimits {
+	return ServerLimits{
+		ReadHeaderTimeout: time.Duration(c.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(c.ReadTimeout),
+		WriteTimeout:      time.Duration(c.WriteTimeout),
+		IdleTimeout:       time.Duration(c.IdleTimeout),
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+		MaxConns:          c.MaxConns,
+	}
+}
+
+func (c *Config) ListenAddr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// all the problems at once, one per line, named like the flags
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(name string, format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: %s", name, fmt.Sprintf(format, a...)))
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		add("port", "must be between 1 and 65535, got %d", c.Port)
+	}
+	// with a snapshot, Run can serve it while the exit list is missing
+	if info, err := os.Stat(c.Base); err != nil || !info.IsDir() {
+		add("base", "%q isn't a directory", c.Base)
+	} else if _, err = os.Stat(path.Join(c.Base, "data/exit-policies")); err != nil && len(c.Snapshot) == 0 {
+		add("base", "no exit list, run build-exits first: %v", err)
+	}
+	if len(c.ExitAddresses) > 0 {
+		if _, err := os.Stat(os.ExpandEnv(c.ExitAddresses)); err != nil {
+			add("exit-addresses", "%v", err)
+		}
+	}
+	if c.Tminus < 1 {
+		add("tminus", "must be at least 1 hour, got %d", c.Tminus)
+	}
+	if c.MaxTminus < c.Tminus {
+		add("max-tminus", "must be at least tminus (%d), got %d", c.Tminus, c.MaxTminus)
+	}
+	if _, err := parseTarget(c.DefaultTarget, false); err != nil {
+		add("default-target", "%v", err)
+	}
+	if _, err := parseTarget(c.DefaultTarget6, true); err != nil {
+		add("default-target6", "%v", err)
+	}
+
+	files := []struct {
+		name string
+		path string
+	}{
+		{"history", c.History},
+		{"snapshot", c.Snapshot},
+	}
+	for _, x := range files {
+		if len(x.path) == 0 {
+			continue
+		}
+		if info, err := os.Stat(path.Dir(x.path)); err != nil || !info.IsDir() {
+			add(x.name, "%q isn't in a directory", x.path)
+		}
+	}
+
+	if len(c.Admin) > 0 && len(c.AdminTokenFile) == 0 {
+		add("admin", "needs admin-token-file")
+	}
+	if _, err := ParseCIDRList(c.TrustedProxies); err != nil {
+		add("trusted-proxies", "%v", err)
+	}
+	if _, err := ParseForwardedHeader(c.ForwardedHeader); err != nil {
+		add("forwarded-header", "%v", err)
+	}
+	if _, err := ParseCIDRList(c.ProxyProtocol); err != nil {
+		add("proxy-protocol", "%v", err)
+	}
+
+	if (len(c.TLSCert) > 0) != (len(c.TLSKey) > 0) {
+		add("tls-cert", "tls-cert and tls-key go together")
+	}
+	if len(c.HTTPRedirect) > 0 {
+		if len(c.TLSCert) == 0 {
+			add("http-redirect", "needs tls-cert and tls-key")
+		}
+		if _, _, err := net.SplitHostPort(c.HTTPRedirect); err != nil {
+			add("http-redirect", "%v", err)
+		}
+	}
+
+	durations := []struct {
+		name string
+		d    Duration
+	}{
+		{"watch", c.Watch},
+		{"max-age", c.MaxAge},
+		{"history-retention", c.HistoryRetention},
+		{"shutdown-timeout", c.ShutdownTimeout},
+		{"read-header-timeout", c.ReadHeaderTimeout},
+		{"read-timeout", c.ReadTimeout},
+		{"write-timeout", c.WriteTimeout},
+		{"idle-timeout", c.IdleTimeout},
+	}
+	for _, x := range durations {
+		if x.d < 0 {
+			add(x.name, "can't be negative, got %v", x.d)
+		}
+	}
+	if c.MaxHeaderBytes < 0 {
+		add("max-header-bytes", "can't be negative, got %d", c.MaxHeaderBytes)
+	}
+	if c.MaxConns < 0 {
+		add("max-conns", "can't be negative, got %d", c.MaxConns)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
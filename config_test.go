@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir string, contents string) string {
+	p := path.Join(dir, "check.json")
+	if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := writeConfig(t, dir, `{
+		"port": 9000,
+		"max-age": "90m",
+		"log": "/var/log/check.log",
+		"pid": "/run/check.pid",
+		"bulk": false
+	}`)
+	env := map[string]string{
+		"CHECK_CONFIG":  configPath,
+		"CHECK_PORT":    "9001",
+		"CHECK_LOG":     "/tmp/check.log",
+		"CHECK_TMINUS":  "24",
+		"CHECK_UNKNOWN": "ignored",
+	}
+
+	c, printConfig, err := LoadConfig([]string{"-port", "9002", "-print-config"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printConfig {
+		t.Error("Expected -print-config")
+	}
+
+	expected := DefaultConfig()
+	// the command line wins
+	expected.Port = 9002
+	// then the environment
+	expected.Log = "/tmp/check.log"
+	expected.Tminus = 24
+	// then the file
+	expected.MaxAge = Duration(90 * time.Minute)
+	expected.Pid = "/run/check.pid"
+	expected.Bulk = false
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("Got %+v, expected %+v", c, expected)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	noenv := func(string) string { return "" }
+
+	tests := []struct {
+		config   string
+		env      map[string]string
+		expected string
+	}{
+		{`{"prot": 9000}`, nil, `unknown field "prot"`},
+		{`{"max-age": 3}`, nil, `durations are strings`},
+		{`{"max-age": "3 hours"}`, nil, `time: unknown unit`},
+		{`{"port": 9000`, nil, `unexpected EOF`},
+		{`{}`, map[string]string{"CHECK_PORT": "http"}, `CHECK_PORT`},
+		{`{}`, map[string]string{"CHECK_WATCH": "often"}, `CHECK_WATCH`},
+	}
+	for _, x := range tests {
+		configPath := writeConfig(t, dir, x.config)
+		getenv := noenv
+		if x.env != nil {
+			getenv = func(k string) string { return x.env[k] }
+		}
+		_, _, err := LoadConfig([]string{"-config", configPath}, getenv)
+		if err == nil || !strings.Contains(err.Error(), x.expected) {
+			t.Errorf("Got %v for %s %v, expected %q", err, x.config, x.env, x.expected)
+		}
+	}
+
+	if _, _, err := LoadConfig([]string{"-config", path.Join(dir, "missing.json")}, noenv); !os.IsNotExist(err) {
+		t.Errorf("Got %v, expected the file not to exist", err)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := DefaultConfig()
+	c.Watch = Duration(time.Minute)
+	c.TrustedProxies = "127.0.0.1,10.0.0.0/8"
+	c.API = false
+	var buf bytes.Buffer
+	if err = c.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"watch": "1m0s"`) {
+		t.Errorf("Expected readable durations, got %s", buf.String())
+	}
+
+	// what's printed can be used as the config file
+	configPath := writeConfig(t, dir, buf.String())
+	read, _, err := LoadConfig([]string{"-config", configPath}, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, c) {
+		t.Errorf("Got %+v, expected %+v", read, c)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(path.Join(dir, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "data/exit-policies"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := DefaultConfig()
+	c.Base = dir
+	if err = c.Validate(); err != nil {
+		t.Errorf("Expected the defaults to be valid, got %v", err)
+	}
+
+	c.Port = 0
+	c.Tminus = 0
+	c.MaxTminus = -1
+	c.DefaultTarget = "[2001:db8::1]:443"
+	c.DefaultTarget6 = "2001:db8::1"
+	c.Admin = "127.0.0.1:9090"
+	c.TrustedProxies = "127.0.0.1,10.0.0.0/33"
+	c.ForwardedHeader = "X-Client-IP"
+	c.TLSCert = "cert.pem"
+	c.HTTPRedirect = "80"
+	c.ReadTimeout = Duration(-time.Second)
+	c.MaxConns = -1
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("Expected an invalid config")
+	}
+	for _, name := range []string{"port", "tminus", "max-tminus", "default-target", "default-target6", "admin", "trusted-proxies", "forwarded-header", "tls-cert", "http-redirect", "read-timeout", "max-conns"} {
+		if !strings.Contains(err.Error(), "\n  "+name+": ") {
+			t.Errorf("Expected a problem with %s in %v", name, err)
+		}
+	}
+
+	c = DefaultConfig()
+	c.Base = path.Join(dir, "missing")
+	if err = c.Validate(); err == nil || !strings.Contains(err.Error(), "base: ") {
+		t.Errorf("Got %v, expected a problem with base", err)
+	}
+}
+
+func TestConfigTargets(t *testing.T) {
+	c := DefaultConfig()
+	c.DefaultTarget = "038.229.072.022:80"
+	c.DefaultTarget6 = "[2001:0db8::1]:8443"
+	target, target6, err := c.Targets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != (AddressPort{"38.229.72.22", 80}) || target6 != (AddressPort{"2001:db8::1", 8443}) {
+		t.Errorf("Got %v and %v", target, target6)
+	}
+
+	// the defaults round trip
+	c = DefaultConfig()
+	if target, target6, err = c.Targets(); err != nil || target != DefaultTarget || target6 != DefaultTarget6 {
+		t.Errorf("Got %v, %v, %v, expected the default targets", target, target6, err)
+	}
+}
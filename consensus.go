@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// time format used throughout the directory protocol
+const DirTimeFormat = "2006-01-02 15:04:05"
+
+type ConsensusRouter struct {
+	Nickname         string
+	Fingerprint      string
+	Address          string
+	ORAddresses      []string
+	Flags            []string
+	Rules            []Rule
+	IsAllowedDefault bool
+}
+
+// the published address and any additional (ipv6) ones from a lines
+func (r ConsensusRouter) Addresses() []string {
+	return append([]string{r.Address}, r.ORAddresses...)
+}
+
+// the p line only covers ipv4, the consensus says nothing about
+// exiting to ipv6 so it's rejected
+func (r ConsensusRouter) PolicyRules() []Rule {
+	rules := []Rule{{IsAccept: false, Address: "::", Mask: "::", MinPort: 1, MaxPort: 65535}}
+	rules[0].resolveAddress()
+	return append(rules, r.Rules...)
+}
+
+func (r ConsensusRouter) IsExitingAllowed() bool {
+	return IsExitingAllowed(r.Rules, r.IsAllowedDefault)
+}
+
+type Consensus struct {
+	ValidAfter time.Time
+	Routers    []ConsensusRouter
+}
+
+// hours elapsed between t and now, rounded down like exitips.py
+func HoursSince(t time.Time, now time.Time) int {
+	h := int(math.Floor(now.Sub(t).Hours()))
+	if h < 0 {
+		h = 0
+	}
+	return h
+}
+
+// the policies of all routers in the consensus that allow exiting
+func (c *Consensus) Policies(now time.Time) []Policy {
+	var exits []Policy
+	tminus := HoursSince(c.ValidAfter, now)
+	for _, r := range c.Routers {
+		if !r.IsExitingAllowed() {
+			continue
+		}
+		exits = append(exits, Policy{
+			Fingerprint:      r.Fingerprint,
+			Address:          r.Addresses(),
+			Rules:            r.PolicyRules(),
+			IsAllowedDefault: r.IsAllowedDefault,
+			Tminus:           tminus,
+			LastSeen:         c.ValidAfter,
+		})
+	}
+	return exits
+}
+
+func DecodeFingerprint(identity string) (string, error) {
+	id, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(identity, "="))
+	if err != nil || len(id) != 20 {
+		return "", fmt.Errorf("invalid identity %q", identity)
+	}
+	return strings.ToUpper(hex.EncodeToString(id)), nil
+}
+
+func parseRouterLine(args []string) (r ConsensusRouter, err error) {
+	// nickname identity digest publication-date publication-time ip orport dirport
+	if len(args) < 8 {
+		return r, fmt.Errorf("invalid r line: %q", strings.Join(args, " "))
+	}
+	if r.Fingerprint, err = DecodeFingerprint(args[1]); err != nil {
+		return
+	}
+	if net.ParseIP(args[5]).To4() == nil {
+		return r, fmt.Errorf("invalid address %q for %s", args[5], r.Fingerprint)
+	}
+	r.Nickname = args[0]
+	r.Address = args[5]
+	// routers without a p line don't allow exiting
+	r.Rules = []Rule{{IsAccept: false, IsAddressWildcard: true, MinPort: 1, MaxPort: 65535}}
+	r.IsAllowedDefault = true
+	return
+}
+
+// parses the address of an "a" or "or-address" line, [ipv6]:port or
+// ipv4:port, into its canonical form
+func parseORAddress(s string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q", s)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() == nil) != strings.HasPrefix(s, "[") {
+		return "", fmt.Errorf("invalid address %q", s)
+	}
+	if _, _, err = ParsePortRange(port); err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// parses a network-status-consensus-3 document
+func ParseConsensus(source io.Reader) (*Consensus, error) {
+	var (
+		c       Consensus
+		router  *ConsensusRouter
+		version bool
+		footer  bool
+		lineNo  int
+	)
+
+	scanner := bufio.NewScanner(source)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		lineNo += 1
+		line := scanner.Text()
+
+		// skip annotations and blank lines
+		if len(line) == 0 || strings.HasPrefix(line, "@") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		keyword, args := fields[0], fields[1:]
+
+		if !version {
+			if keyword != "network-status-version" || len(args) < 1 || args[0] != "3" {
+				return nil, fmt.Errorf("line %d: not a network-status-consensus-3 document", lineNo)
+			}
+			version = true
+			continue
+		}
+
+		if footer {
+			continue
+		}
+
+		var err error
+		switch keyword {
+		case "valid-after":
+			c.ValidAfter, err = time.Parse(DirTimeFormat, strings.Join(args, " "))
+		case "r":
+			var r ConsensusRouter
+			if r, err = parseRouterLine(args); err == nil {
+				c.Routers = append(c.Routers, r)
+				router = &c.Routers[len(c.Routers)-1]
+			}
+		case "a":
+			if router != nil && len(args) == 1 {
+				var a string
+				if a, err = parseORAddress(args[0]); err == nil {
+					InsertUnique(&router.ORAddresses, a)
+				}
+			}
+		case "s":
+			if router != nil {
+				router.Flags = args
+			}
+		case "p":
+			if router != nil {
+				router.Rules, router.IsAllowedDefault, err = ParsePolicySummary(strings.Join(args, " "))
+			}
+		case "directory-footer":
+			footer = true
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !version {
+		return nil, fmt.Errorf("empty consensus")
+	}
+	if c.ValidAfter.IsZero() {
+		return nil, fmt.Errorf("consensus is missing valid-after")
+	}
+
+	return &c, nil
+}
+
+func ParseConsensusFile(filePath string) (*Consensus, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	c, err := ParseConsensus(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadConsensus(t *testing.T, filePath string) *Consensus {
+	c, err := ParseConsensusFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func findRouter(c *Consensus, nickname string) *ConsensusRouter {
+	for i := range c.Routers {
+		if c.Routers[i].Nickname == nickname {
+			return &c.Routers[i]
+		}
+	}
+	return nil
+}
+
+func TestParseConsensus(t *testing.T) {
+	c := loadConsensus(t, "testdata/consensuses/2019-01-01-12-00-00-consensus")
+
+	if expected := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC); !c.ValidAfter.Equal(expected) {
+		t.Errorf("Got valid-after %v, expected %v", c.ValidAfter, expected)
+	}
+	if len(c.Routers) != 4 {
+		t.Fatalf("Got %d routers, expected 4", len(c.Routers))
+	}
+
+	r := findRouter(c, "exit1")
+	if r == nil {
+		t.Fatal("Missing exit1")
+	}
+	if r.Fingerprint != "C1032C7046EF1D28E5D6D3EE402C21B0036EC52F" {
+		t.Errorf("Got fingerprint %s", r.Fingerprint)
+	}
+	if r.Address != "91.121.43.80" {
+		t.Errorf("Got address %s", r.Address)
+	}
+	if r.IsAllowedDefault {
+		t.Error("Accept summary should not be allowed by default")
+	}
+	if len(r.Rules) != 6 {
+		t.Errorf("Got %d rules, expected 6", len(r.Rules))
+	}
+	if last := r.Rules[len(r.Rules)-1]; !last.IsAccept || !last.IsAddressWildcard || last.MinPort != 8080 || last.MaxPort != 8080 {
+		t.Errorf("Unexpected last rule %+v", last)
+	}
+
+	r = findRouter(c, "exit2")
+	if r == nil || !r.IsAllowedDefault || r.Rules[0].IsAccept {
+		t.Errorf("Reject summary not parsed correctly: %+v", r)
+	}
+
+	r = findRouter(c, "exit3")
+	if r == nil || len(r.ORAddresses) != 1 || r.ORAddresses[0] != "2001:db8:3::1" {
+		t.Errorf("a line not parsed correctly: %+v", r)
+	}
+
+	r = findRouter(c, "middle1")
+	if r == nil || r.IsExitingAllowed() {
+		t.Error("middle1 shouldn't allow exiting")
+	}
+}
+
+func TestConsensusPolicies(t *testing.T) {
+	c := loadConsensus(t, "testdata/consensuses/2019-01-01-12-00-00-consensus")
+	now := c.ValidAfter.Add(3*time.Hour + 30*time.Minute)
+
+	exits := c.Policies(now)
+	if len(exits) != 3 {
+		t.Fatalf("Got %d exits, expected 3", len(exits))
+	}
+	for _, p := range exits {
+		if p.Tminus != 3 {
+			t.Errorf("Got tminus %d for %s, expected 3", p.Tminus, p.Fingerprint)
+		}
+	}
+
+	e := &Exits{now: func() time.Time { return now }}
+	e.Update(exits, false)
+
+	e.assertIsTor(t, "91.121.43.80", true)
+	e.assertIsTor(t, "83.227.52.198", true)
+	e.assertIsTor(t, "51.15.43.205", true)
+	e.assertIsTor(t, "62.210.92.11", false)
+
+	expectDump(t, e, "38.229.70.31", 443, "91.121.43.80", "83.227.52.198", "51.15.43.205")
+	expectDump(t, e, "38.229.70.31", 80, "91.121.43.80", "83.227.52.198")
+	expectDump(t, e, "38.229.70.31", 25)
+
+	// exit3's ipv6 address is known, but the consensus doesn't say
+	// whether it exits to ipv6
+	e.assertIsTor(t, "2001:db8:3::1", false)
+	expectDump(t, e, "2001:db8:4::1", 443)
+}
+
+func TestParseORAddress(t *testing.T) {
+	tests := map[string]string{
+		"[2001:db8::1]:9001":         "2001:db8::1",
+		"[2001:0DB8:0:0::1]:443":     "2001:db8::1",
+		"91.121.43.80:9001":          "91.121.43.80",
+		"2001:db8::1:9001":           "",
+		"[91.121.43.80]:9001":        "",
+		"[2001:db8::1]":              "",
+		"[2001:db8::1]:70000":        "",
+		"[2001:db8::zz]:9001":        "",
+		"[::ffff:91.121.43.80]:9001": "",
+	}
+	for s, expected := range tests {
+		a, err := parseORAddress(s)
+		if (err != nil) != (expected == "") || a != expected {
+			t.Errorf("Got %q, %v for %s, expected %q", a, err, s, expected)
+		}
+	}
+}
+
+// the file with CRLF line endings and a whitespace only line after each
+// line, the way hand edited files can end up
+func withBlankLines(t *testing.T, filePath string) string {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(string(b), "\n", "\r\n \t\r\n", -1)
+}
+
+func TestParseConsensusBlankLines(t *testing.T) {
+	filePath := "testdata/consensuses/2019-01-01-12-00-00-consensus"
+	c, err := ParseConsensus(strings.NewReader(withBlankLines(t, filePath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := loadConsensus(t, filePath); !reflect.DeepEqual(c, expected) {
+		t.Errorf("Got %+v, expected %+v", c, expected)
+	}
+}
+
+func TestParseConsensusErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":        "",
+		"not a vote":   "network-status-version 2\n",
+		"no timestamp": "network-status-version 3\nvote-status consensus\n",
+		"bad identity": "network-status-version 3\nvalid-after 2019-01-01 12:00:00\nr exit1 !!! digest 2019-01-01 06:51:16 91.121.43.80 9001 0\n",
+		"bad summary":  "network-status-version 3\nvalid-after 2019-01-01 12:00:00\nr exit1 wQMscEbvHSjl1tPuQCwhsANuxS8 digest 2019-01-01 06:51:16 91.121.43.80 9001 0\np accept 80-\n",
+		"bad a line":   "network-status-version 3\nvalid-after 2019-01-01 12:00:00\nr exit1 wQMscEbvHSjl1tPuQCwhsANuxS8 digest 2019-01-01 06:51:16 91.121.43.80 9001 0\na 2001:db8::1:9001\n",
+	}
+	for name, doc := range tests {
+		if _, err := ParseConsensus(strings.NewReader(doc)); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestIsExitingAllowed(t *testing.T) {
+	tests := map[string]bool{
+		"accept 80,443":            true,
+		"reject 1-65535":           false,
+		"reject 25,119":            true,
+		"reject 1-1000,1001-65535": false,
+	}
+	for summary, expected := range tests {
+		rules, isAllowedDefault, err := ParsePolicySummary(summary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := IsExitingAllowed(rules, isAllowedDefault); got != expected {
+			t.Errorf("Got %v for %q, expected %v", got, summary, expected)
+		}
+	}
+
+	// rejected ports are skipped when looking for accepts
+	rules := []Rule{
+		{IsAccept: false, IsAddressWildcard: true, MinPort: 1, MaxPort: 1024},
+		{IsAccept: true, IsAddressWildcard: true, MinPort: 80, MaxPort: 80},
+		{IsAccept: false, IsAddressWildcard: true, MinPort: 1, MaxPort: 65535},
+	}
+	if IsExitingAllowed(rules, true) {
+		t.Error("Accepting an already rejected port shouldn't allow exiting")
+	}
+}
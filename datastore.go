@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -17,8 +21,8 @@ type Rule struct {
 	IsAddressWildcard bool
 	Address           string
 	Mask              string
-	IP                net.IP
-	IPNet             *net.IPNet
+	IP                net.IP     `json:"-"`
+	IPNet             *net.IPNet `json:"-"`
 	MinPort           int
 	MaxPort           int
 }
@@ -41,6 +45,23 @@ func (r Rule) IsMatch(address net.IP, port int) bool {
 	return true
 }
 
+// sets IP and IPNet from Address and Mask
+func (r *Rule) resolveAddress() {
+	if r.IsAddressWildcard {
+		return
+	}
+	r.IP = ParseAddress(r.Address)
+	mask := net.ParseIP(r.Mask)
+	if len(r.IP) == net.IPv4len {
+		mask = mask.To4()
+	}
+	if r.IP != nil && mask != nil {
+		m := make(net.IPMask, len(mask))
+		copy(m, mask)
+		r.IPNet = &net.IPNet{IP: r.IP.Mask(m), Mask: m}
+	}
+}
+
 func ValidPort(port int) bool {
 	return port >= 0 && port < 65536
 }
@@ -50,54 +71,67 @@ type AddressPort struct {
 	Port    int
 }
 
-type CanExitCache struct {
-	ap  AddressPort
-	can bool
-}
-
 type Policy struct {
 	Fingerprint      string
 	Address          []string
 	Rules            []Rule
 	IsAllowedDefault bool
-	Tminus           int
-	CacheLast        CanExitCache
+	// hours since LastSeen, as of when the generation was loaded
+	Tminus int
+	// the valid-after of the latest consensus it was in, or when
+	// TorDNSEL last saw it exit if that's later
+	LastSeen time.Time
+	// when it was last seen at each address, so the ones it has moved
+	// from expire while it's still running. addresses missing from it
+	// were seen at LastSeen
+	AddressSeen map[string]time.Time `json:",omitempty"`
 }
 
-func (p Policy) CanExit(ap AddressPort) (can bool) {
-	if p.CacheLast.ap == ap {
-		can = p.CacheLast.can
-		return
+// adds addr, seen at t, keeping the latest time for it and the exit
+func (p *Policy) seeAddress(addr string, t time.Time) {
+	InsertUnique(&p.Address, addr)
+	if p.AddressSeen == nil {
+		p.AddressSeen = make(map[string]time.Time)
 	}
+	if seen, ok := p.AddressSeen[addr]; !ok || t.After(seen) {
+		p.AddressSeen[addr] = t
+	}
+	if t.After(p.LastSeen) {
+		p.LastSeen = t
+	}
+}
 
-	// update the cache *after* we return
-	defer func() {
-		p.CacheLast = CanExitCache{ap, can}
-	}()
-
-	addr := net.ParseIP(ap.Address)
+// walks the rules, compiledPolicy gives the same answers quicker
+func (p Policy) CanExit(ap AddressPort) bool {
+	addr := ParseAddress(ap.Address)
 	if addr != nil && ValidPort(ap.Port) {
 		for _, rule := range p.Rules {
 			if rule.IsMatch(addr, ap.Port) {
-				can = rule.IsAccept
-				return
+				return rule.IsAccept
 			}
 		}
 	}
-
-	can = p.IsAllowedDefault
-	return
+	return p.IsAllowedDefault
 }
 
 type PolicyAddress struct {
 	Policy  Policy
 	Address string
+	// when the exit was last seen at Address, and the hours since as of
+	// when the generation was loaded
+	LastSeen time.Time
+	Tminus   int
 }
 
 type PolicyList []PolicyAddress
 
+// exits sharing an address by fingerprint, so lookups list them in the
+// same order every time
 func (p PolicyList) Less(i, j int) bool {
-	return p[i].Address < p[j].Address
+	if p[i].Address != p[j].Address {
+		return p[i].Address < p[j].Address
+	}
+	return p[i].Policy.Fingerprint < p[j].Policy.Fingerprint
 }
 
 func (p PolicyList) Len() int {
@@ -121,17 +155,59 @@ func (e ExitInfo) toJSON() (b []byte) {
 	return j
 }
 
-type Exits struct {
-	List        PolicyList
-	UpdateTime  time.Time
-	ReloadChan  chan os.Signal
-	IsTorLookup map[string]string
+// a generation of the exit data, never modified once published
+type ExitData struct {
+	Generation uint64
+	List       PolicyList
+	UpdateTime time.Time
+	// when the newest exit in List was last seen, reloading old data
+	// doesn't make it any fresher
+	DataTime      time.Time
+	ExitAddresses map[string][]ExitAddress
+
+	// the distinct policies in List, and List's index into them
+	compiled []compiledPolicy
+	index    []int
+	// exit address -> indexes into List
+	addresses *IPTree
+	// whether each address in List is ipv6
+	ipv6 []bool
+	// whether each compiled policy can reach the default targets, from
+	// an ipv4 and an ipv6 address
+	isTor  []bool
+	isTor6 []bool
+	// rendered bulk lists, for this generation only
+	bulk *bulkCache
 }
 
-func (e *Exits) Dump(w io.Writer, tminus int, ip string, port int) {
+func (d *ExitData) Dump(w io.Writer, tminus int, ip string, port int) {
+	w.Write(d.bulkList(newBulkKey(ip, port, tminus, false)))
+}
+
+func (d *ExitData) DumpJSON(w io.Writer, tminus int, ip string, port int) {
+	w.Write(d.bulkList(newBulkKey(ip, port, tminus, true)))
+}
+
+// the rendered list, from the cache if someone asked for it already
+func (d *ExitData) bulkList(key bulkKey) []byte {
+	if body, ok := d.bulk.Get(key); ok {
+		return body
+	}
+	buf := new(bytes.Buffer)
+	if key.JSON {
+		d.dumpJSON(buf, key.Tminus, key.IP, key.Port)
+	} else {
+		d.dump(buf, key.Tminus, key.IP, key.Port)
+	}
+	body := buf.Bytes()
+	d.bulk.Put(key, body)
+	return body
+}
+
+func (d *ExitData) dump(w io.Writer, tminus int, ip string, port int) {
 	ap := AddressPort{ip, port}
 	var last string
-	e.GetAllExits(ap, tminus, func(exit string, _ string, _ int) {
+	d.GetAllExits(ap, tminus, func(exit string, _ string, _ int) {
 		if exit != last {
 			w.Write([]byte(exit + "\n"))
 			last = exit
@@ -139,11 +215,11 @@ func (e *Exits) Dump(w io.Writer, tminus int, ip string, port int) {
 	})
 }
 
-func (e *Exits) DumpJSON(w io.Writer, tminus int, ip string, port int) {
+func (d *ExitData) dumpJSON(w io.Writer, tminus int, ip string, port int) {
 	ap := AddressPort{ip, port}
 	Prefix := []byte(",\n")
 	w.Write([]byte("["))
-	e.GetAllExits(ap, tminus, func(address string, fingerprint string, ind int) {
+	d.GetAllExits(ap, tminus, func(address string, fingerprint string, ind int) {
 		if ind > 0 {
 			w.Write(Prefix)
 		}
@@ -152,10 +228,23 @@ func (e *Exits) DumpJSON(w io.Writer, tminus int, ip string, port int) {
 	w.Write([]byte("]"))
 }
 
-func (e *Exits) GetAllExits(ap AddressPort, tminus int, fn func(string, string, int)) {
+// each policy is evaluated once, rather than once per address. only
+// exit addresses of the target's family are listed since those are the
+// ones its connections come from
+func (d *ExitData) GetAllExits(ap AddressPort, tminus int, fn func(string, string, int)) {
+	addr := ParseAddress(ap.Address)
+	can := make([]bool, len(d.compiled))
+	for i := range d.compiled {
+		c := &d.compiled[i]
+		can[i] = c.CanExit(addr, ap.Port)
+	}
+
 	ind := 0
-	for _, val := range e.List {
-		if val.Policy.Tminus <= tminus && val.Policy.CanExit(ap) {
+	for i, val := range d.List {
+		if addr != nil && d.ipv6[i] != isIPv6(addr) {
+			continue
+		}
+		if val.Tminus <= tminus && can[d.index[i]] {
 			fn(val.Address, val.Policy.Fingerprint, ind)
 			ind += 1
 		}
@@ -164,19 +253,206 @@ func (e *Exits) GetAllExits(ap AddressPort, tminus int, fn func(string, string,
 
 var DefaultTarget = AddressPort{"38.229.72.22", 443}
 
-func (e *Exits) PreComputeTorList() {
-	newmap := make(map[string]string)
-	e.GetAllExits(DefaultTarget, 16, func(ip string, fingerprint string, _ int) {
-		newmap[ip] = fingerprint
-	})
-	e.IsTorLookup = newmap
+// hours since an exit was last seen that it still counts for IsTor,
+// and the bulk list's default n
+var DefaultTminus = 16
+
+// exits are forgotten once they haven't been seen for longer than this
+var MaxTminus = 24
+
+// check.torproject.org's ipv6 address, for users connecting over ipv6
+var DefaultTarget6 = AddressPort{"2620:7:6002:0:3eec:efff:fed5:6b55", 443}
+
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil
 }
 
-func (e *Exits) IsTor(remoteAddr string) (fingerprint string, ok bool) {
-	fingerprint, ok = e.IsTorLookup[remoteAddr]
+// compiles the policies and indexes them by exit address
+func (d *ExitData) buildIndex() {
+	d.compiled = nil
+	d.index = make([]int, len(d.List))
+	d.ipv6 = make([]bool, len(d.List))
+	d.addresses = new(IPTree)
+	seen := make(map[string]int)
+	for i := range d.List {
+		p := &d.List[i].Policy
+		j, ok := seen[p.Fingerprint]
+		if !ok {
+			j = len(d.compiled)
+			seen[p.Fingerprint] = j
+			d.compiled = append(d.compiled, compilePolicy(p))
+		}
+		d.index[i] = j
+
+		ip := ParseAddress(d.List[i].Address)
+		bits := 8 * net.IPv4len
+		if d.ipv6[i] = isIPv6(ip); d.ipv6[i] {
+			bits = 8 * net.IPv6len
+		}
+		v, _ := d.addresses.Lookup(ip)
+		is, _ := v.([]int)
+		d.addresses.Insert(ip, bits, append(is, i))
+	}
+
+	target, target6 := net.ParseIP(DefaultTarget.Address), net.ParseIP(DefaultTarget6.Address)
+	d.isTor = make([]bool, len(d.compiled))
+	d.isTor6 = make([]bool, len(d.compiled))
+	for i := range d.compiled {
+		c := &d.compiled[i]
+		d.isTor[i] = c.CanExit(target, DefaultTarget.Port)
+		d.isTor6[i] = c.CanExit(target6, DefaultTarget6.Port)
+	}
+}
+
+// whether List[i] counts for IsTor, the exit was at the address
+// recently enough and could reach the default target for its family
+func (d *ExitData) isTorFrom(i int) bool {
+	if d.List[i].Tminus > DefaultTminus {
+		return false
+	}
+	if d.ipv6[i] {
+		return d.isTor6[d.index[i]]
+	}
+	return d.isTor[d.index[i]]
+}
+
+// users connecting over ipv6 are checked against DefaultTarget6
+func (d *ExitData) IsTor(remoteAddr string) (fingerprint string, ok bool) {
+	if d.addresses == nil {
+		return
+	}
+	ip := ParseAddress(remoteAddr)
+	v, found := d.addresses.Lookup(ip)
+	if !found {
+		return
+	}
+	for _, i := range v.([]int) {
+		if d.isTorFrom(i) {
+			return d.List[i].Policy.Fingerprint, true
+		}
+	}
+	return
+}
+
+// the exits at ip that could reach the target, like IsTor does for the
+// default targets, once per fingerprint
+func (d *ExitData) exitsTo(ip net.IP, target AddressPort) (exits []*PolicyAddress) {
+	if d.addresses == nil {
+		return
+	}
+	v, found := d.addresses.Lookup(ip)
+	if !found {
+		return
+	}
+	tip := net.ParseIP(target.Address)
+	seen := make(map[string]bool)
+	for _, i := range v.([]int) {
+		pa := &d.List[i]
+		if !seen[pa.Policy.Fingerprint] && pa.Tminus <= DefaultTminus && d.compiled[d.index[i]].CanExit(tip, target.Port) {
+			seen[pa.Policy.Fingerprint] = true
+			exits = append(exits, pa)
+		}
+	}
+	return
+}
+
+func (d *ExitData) ExitsTo(remoteAddr string, target AddressPort) (fingerprints []string) {
+	for _, pa := range d.exitsTo(ParseAddress(remoteAddr), target) {
+		fingerprints = append(fingerprints, pa.Policy.Fingerprint)
+	}
 	return
 }
 
+// the addresses IsTor is true for
+func (d *ExitData) TorAddresses() []string {
+	var addrs []string
+	for i, val := range d.List {
+		if d.isTorFrom(i) {
+			addrs = append(addrs, val.Address)
+		}
+	}
+	return addrs
+}
+
+// the loaded policies, once per fingerprint
+func (d *ExitData) Policies() []Policy {
+	var exits []Policy
+	seen := make(map[string]bool)
+	for _, p := range d.List {
+		if !seen[p.Policy.Fingerprint] {
+			seen[p.Policy.Fingerprint] = true
+			exits = append(exits, p.Policy)
+		}
+	}
+	return exits
+}
+
+// stale once the newest exit was seen more than maxAge ago, or if
+// nothing was ever loaded. a zero maxAge never goes stale
+func (d *ExitData) IsStale(maxAge time.Duration, now time.Time) bool {
+	if d.Generation == 0 {
+		return true
+	}
+	return maxAge > 0 && now.Sub(d.DataTime) > maxAge
+}
+
+type Exits struct {
+	ReloadChan chan os.Signal
+	MaxAge     time.Duration
+	// if set, every generation is recorded in it
+	History *History
+	// if set, every generation is saved to it and restored by Run
+	SnapshotPath string
+	// policies are kept as they were loaded, with the Tminus they were
+	// written with and nothing aged or expired, for comparing exit lists
+	AsWritten bool
+
+	// the time generations are aged to, time.Now if nil
+	now      func() time.Time
+	data     atomic.Value
+	mu       sync.Mutex
+	saveMu   sync.Mutex
+	status   ReloadStatus
+	statusMu sync.Mutex
+}
+
+// the current generation, requests should hold on to it rather than
+// calling back into Exits so they see consistent data
+func (e *Exits) Current() *ExitData {
+	if d, ok := e.data.Load().(*ExitData); ok {
+		return d
+	}
+	return new(ExitData)
+}
+
+func (e *Exits) Dump(w io.Writer, tminus int, ip string, port int) {
+	e.Current().Dump(w, tminus, ip, port)
+}
+
+func (e *Exits) DumpJSON(w io.Writer, tminus int, ip string, port int) {
+	e.Current().DumpJSON(w, tminus, ip, port)
+}
+
+func (e *Exits) IsTor(remoteAddr string) (fingerprint string, ok bool) {
+	return e.Current().IsTor(remoteAddr)
+}
+
+func (e *Exits) IsStale() bool {
+	return e.Current().IsStale(e.MaxAge, e.clock())
+}
+
+func (e *Exits) Policies() []Policy {
+	return e.Current().Policies()
+}
+
+// the address as net.IP prints it, or as is if it doesn't parse
+func CanonicalIP(a string) string {
+	if ip := ParseAddress(a); ip != nil {
+		return ip.String()
+	}
+	return a
+}
+
 func InsertUnique(arr *[]string, a string) {
 	for _, b := range *arr {
 		if a == b {
@@ -186,44 +462,215 @@ func InsertUnique(arr *[]string, a string) {
 	*arr = append(*arr, a)
 }
 
-func (e *Exits) Update(exits []Policy, update bool) {
+func mergePolicies(list PolicyList, exits []Policy, update bool, exitAddresses map[string][]ExitAddress, now time.Time) PolicyList {
 	m := make(map[string]Policy)
 
-	// bump entries by an hour that aren't in the new exit list
+	// keep the entries that aren't in the new exit list, they're aged
+	// with the rest below. the addresses are gathered afresh since the
+	// list belongs to a published generation
 	if update {
-		for _, p := range e.List {
-			if _, ok := m[p.Policy.Fingerprint]; !ok {
-				p.Policy.Tminus = p.Policy.Tminus + 1
-				m[p.Policy.Fingerprint] = p.Policy
+		for _, pa := range list {
+			p, ok := m[pa.Policy.Fingerprint]
+			if !ok {
+				p = pa.Policy
+				p.Address, p.AddressSeen = nil, nil
 			}
+			p.seeAddress(pa.Address, pa.LastSeen)
+			m[p.Fingerprint] = p
 		}
 	}
 
-	// keep all unique ips we've seen
-	for _, p := range exits {
+	// keep all unique ips we've seen, in canonical form so lookups and
+	// dumps don't depend on how they were written
+	for _, x := range exits {
+		p := x
+		p.Address, p.AddressSeen = nil, nil
+		// exit lists from before LastSeen was written
+		if p.LastSeen.IsZero() && !now.IsZero() {
+			p.LastSeen = now.Add(-time.Duration(p.Tminus) * time.Hour)
+		}
+		for _, a := range x.Address {
+			seen, ok := x.AddressSeen[a]
+			if !ok {
+				seen = p.LastSeen
+			}
+			p.seeAddress(CanonicalIP(a), seen)
+		}
 		if q, ok := m[p.Fingerprint]; ok {
 			for _, a := range q.Address {
-				InsertUnique(&p.Address, a)
+				p.seeAddress(a, q.AddressSeen[a])
+			}
+			if q.LastSeen.After(p.LastSeen) {
+				p.LastSeen = q.LastSeen
 			}
 		}
 		m[p.Fingerprint] = p
 	}
 
+	// add the addresses TorDNSEL measured, which also says when the exit
+	// was last running
+	for fingerprint, as := range exitAddresses {
+		if p, ok := m[fingerprint]; ok {
+			for _, a := range as {
+				p.seeAddress(CanonicalIP(a.Address), a.Time)
+			}
+			m[fingerprint] = p
+		}
+	}
+
+	// age by the time that has actually passed, however often we're
+	// reloaded, and forget what's too old, each address on its own.
+	// without a time they're kept as they were written
 	var pl PolicyList
 	for _, p := range m {
+		if !now.IsZero() {
+			var kept []string
+			for _, a := range p.Address {
+				if HoursSince(p.AddressSeen[a], now) <= MaxTminus {
+					kept = append(kept, a)
+				} else {
+					delete(p.AddressSeen, a)
+				}
+			}
+			p.Address = kept
+			if p.Tminus = HoursSince(p.LastSeen, now); p.Tminus > MaxTminus || len(kept) == 0 {
+				continue
+			}
+		}
 		for _, a := range p.Address {
-			pl = append(pl, PolicyAddress{p, a})
+			pa := PolicyAddress{Policy: p, Address: a, LastSeen: p.AddressSeen[a], Tminus: p.Tminus}
+			if !now.IsZero() {
+				pa.Tminus = HoursSince(pa.LastSeen, now)
+			}
+			pl = append(pl, pa)
 		}
 	}
 
 	// sort -n
 	sort.Sort(pl)
 
-	e.List = pl
+	return pl
 }
 
-func (e *Exits) Load(source io.Reader, update bool) error {
-	var exits []Policy
+// builds the generation after the current one
+func (e *Exits) next(exits []Policy, update bool, exitAddresses map[string][]ExitAddress, updateTime time.Time) *ExitData {
+	current := e.Current()
+	var now time.Time
+	if !e.AsWritten {
+		now = updateTime
+	}
+	d := &ExitData{
+		Generation:    current.Generation + 1,
+		List:          mergePolicies(current.List, exits, update, exitAddresses, now),
+		UpdateTime:    updateTime,
+		ExitAddresses: exitAddresses,
+		bulk:          newBulkCache(BulkCacheSize),
+	}
+	for _, pa := range d.List {
+		if pa.LastSeen.After(d.DataTime) {
+			d.DataTime = pa.LastSeen
+		}
+	}
+	// exits compared as written may not have a time
+	if d.DataTime.IsZero() {
+		d.DataTime = updateTime
+	}
+	d.buildIndex()
+	return d
+}
+
+// the time exits are aged and the data goes stale by
+func (e *Exits) clock() time.Time {
+	if e.now != nil {
+		return e.now()
+	}
+	return time.Now()
+}
+
+// builds the next generation and swaps it in, callers hold e.mu and
+// call save once they've let go of it
+func (e *Exits) publish(exits []Policy, update bool, exitAddresses map[string][]ExitAddress) {
+	d := e.next(exits, update, exitAddresses, e.clock())
+	e.data.Store(d)
+	if e.History != nil {
+		e.History.Record(d)
+	}
+}
+
+// writes the snapshot and history files, called without e.mu so
+// reloads don't wait on the disk. the snapshot is of whatever is
+// current by then, so a slow save never overwrites a newer one
+func (e *Exits) save() {
+	if len(e.SnapshotPath) > 0 {
+		e.saveMu.Lock()
+		err := WriteSnapshot(e.SnapshotPath, e.Current().Snapshot())
+		e.saveMu.Unlock()
+		if err != nil {
+			log.Printf("Saving the snapshot failed: %v", err)
+		}
+	}
+	if e.History != nil {
+		if err := e.History.Save(); err != nil {
+			log.Printf("Saving the history failed: %v", err)
+		}
+	}
+}
+
+func (e *Exits) Update(exits []Policy, update bool) {
+	e.mu.Lock()
+	e.publish(exits, update, e.Current().ExitAddresses)
+	e.mu.Unlock()
+	e.save()
+}
+
+func (e *Exits) LoadExitList(source io.Reader) error {
+	entries, err := ParseExitList(source)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	current := e.Current()
+	e.publish(current.Policies(), false, MergeExitAddresses(current.ExitAddresses, entries))
+	e.mu.Unlock()
+	e.save()
+	return nil
+}
+
+func validatePolicy(p Policy) error {
+	if len(p.Fingerprint) == 0 {
+		return fmt.Errorf("missing fingerprint")
+	}
+	for _, a := range p.Address {
+		if ParseAddress(a) == nil {
+			return fmt.Errorf("%s has an invalid address %q", p.Fingerprint, a)
+		}
+	}
+	for _, r := range p.Rules {
+		if !ValidPort(r.MinPort) || !ValidPort(r.MaxPort) || r.MinPort > r.MaxPort {
+			return fmt.Errorf("%s has an invalid port range %d-%d", p.Fingerprint, r.MinPort, r.MaxPort)
+		}
+		if r.IsAddressWildcard {
+			continue
+		}
+		if r.IP == nil {
+			return fmt.Errorf("%s has an invalid rule address %q", p.Fingerprint, r.Address)
+		}
+		if len(r.Mask) > 0 && r.IPNet == nil {
+			return fmt.Errorf("%s has an invalid rule mask %q", p.Fingerprint, r.Mask)
+		}
+	}
+	return nil
+}
+
+// reads and validates all the policies before anything is replaced,
+// so a truncated or corrupt file is rejected as a whole. Exits without
+// an address are skipped, exitips.py writes those when TorDNSEL has an
+// entry for a relay but no addresses
+func ParsePolicies(source io.Reader) ([]Policy, error) {
+	var (
+		exits []Policy
+		n     int
+	)
 	dec := json.NewDecoder(source)
 
 	for {
@@ -231,48 +678,144 @@ func (e *Exits) Load(source io.Reader, update bool) error {
 		if err := dec.Decode(&p); err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return nil, fmt.Errorf("policy %d: %v", n+1, err)
 		}
 		for i := range p.Rules {
-			r := &p.Rules[i]
-			if !r.IsAddressWildcard {
-				r.IP = net.ParseIP(r.Address)
-				if mask := net.ParseIP(r.Mask); r.IP != nil && mask != nil {
-					m := make(net.IPMask, len(mask))
-					copy(m, mask)
-					r.IPNet = &net.IPNet{IP: r.IP.Mask(m), Mask: m}
-				}
-			}
+			p.Rules[i].resolveAddress()
+		}
+		n++
+		if err := validatePolicy(p); err != nil {
+			return nil, fmt.Errorf("policy %d: %v", n, err)
+		}
+		if len(p.Address) > 0 {
+			exits = append(exits, p)
 		}
-		exits = append(exits, p)
 	}
 
+	if len(exits) == 0 {
+		return nil, fmt.Errorf("no exit policies")
+	}
+	return exits, nil
+}
+
+func (e *Exits) Load(source io.Reader, update bool) error {
+	exits, err := ParsePolicies(source)
+	if err != nil {
+		return err
+	}
 	e.Update(exits, update)
-	e.UpdateTime = time.Now()
-	e.PreComputeTorList()
 	return nil
 }
 
-func (e *Exits) LoadFromFile(filePath string, update bool) {
+func (e *Exits) LoadFromFile(filePath string, update bool) error {
 	file, err := os.Open(os.ExpandEnv(filePath))
-	defer file.Close()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer file.Close()
 	if err = e.Load(file, update); err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("%s: %v", filePath, err)
 	}
+	return nil
+}
+
+type ReloadStatus struct {
+	LastSuccess time.Time
+	LastFailure time.Time
+	LastError   string
+	Failures    int
+}
+
+func (e *Exits) ReloadStatus() ReloadStatus {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	return e.status
+}
+
+func (e *Exits) recordReload(err error) {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	if err != nil {
+		e.status.LastFailure = time.Now()
+		e.status.LastError = err.Error()
+		e.status.Failures += 1
+	} else {
+		e.status.LastSuccess = time.Now()
+	}
+}
+
+// reads the policies and, if exitListPath is set, TorDNSEL's measured
+// addresses and publishes them together. on error the current data is
+// left untouched
+func (e *Exits) Reload(filePath string, exitListPath string, update bool) error {
+	err := e.reload(filePath, exitListPath, update)
+	e.recordReload(err)
+	return err
 }
 
-func (e *Exits) Run(filePath string) {
+func (e *Exits) reload(filePath string, exitListPath string, update bool) error {
+	file, err := os.Open(os.ExpandEnv(filePath))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	exits, err := ParsePolicies(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filePath, err)
+	}
+	// exitips.py's Tminus is as of when it wrote the file
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	for i := range exits {
+		if exits[i].LastSeen.IsZero() {
+			exits[i].LastSeen = info.ModTime().Add(-time.Duration(exits[i].Tminus) * time.Hour)
+		}
+	}
+
+	var entries []ExitListEntry
+	if len(exitListPath) > 0 {
+		if entries, err = ParseExitListFile(os.ExpandEnv(exitListPath)); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	e.publish(exits, update, MergeExitAddresses(e.Current().ExitAddresses, entries))
+	e.mu.Unlock()
+	e.save()
+	return nil
+}
+
+// exitListPath is optional, if set TorDNSEL's measured addresses are
+// merged in on every load. only the initial load can fail, and not if
+// there's a snapshot to serve. later reloads keep serving the previous
+// data and log the error
+func (e *Exits) Run(filePath string, exitListPath string) error {
+	// carry on from the snapshot, if there's one, and serve it even if the
+	// exit list can't be read
+	restored, err := e.restoreSnapshot()
+	if err != nil {
+		log.Printf("Restoring the snapshot failed, starting over: %v", err)
+	}
+	if err = e.Reload(filePath, exitListPath, restored); err != nil {
+		if !restored {
+			return err
+		}
+		log.Printf("Loading the exit list failed, serving the snapshot: %v", err)
+	}
 	e.ReloadChan = make(chan os.Signal, 1)
 	signal.Notify(e.ReloadChan, syscall.SIGUSR2)
 	go func() {
 		for {
 			<-e.ReloadChan
-			e.LoadFromFile(filePath, true)
-			log.Println("Exit list updated.")
+			if err := e.Reload(filePath, exitListPath, true); err != nil {
+				log.Printf("Reloading the exit list failed, keeping the previous one: %v", err)
+			} else {
+				log.Println("Exit list updated.")
+			}
 		}
 	}()
-	e.LoadFromFile(filePath, false)
+	return nil
 }
@@ -2,8 +2,18 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func dependOn(t *testing.T, deps ...func(*testing.T)) {
@@ -181,9 +191,406 @@ func TestPastHours(t *testing.T) {
 	expectDump(t, exits, "123.123.123.123", 80, "111.111.111.111")
 }
 
+func agingPolicy(fingerprint string, address string, lastSeen time.Time) Policy {
+	return Policy{
+		Fingerprint: fingerprint,
+		Address:     []string{address},
+		Rules:       []Rule{{IsAccept: true, MinPort: 1, MaxPort: 65535, IsAddressWildcard: true}},
+		LastSeen:    lastSeen,
+	}
+}
+
+func tminusOf(e *Exits) map[string]int {
+	m := make(map[string]int)
+	for _, p := range e.Policies() {
+		m[p.Fingerprint] = p.Tminus
+	}
+	return m
+}
+
+func TestAgingIrregularReloads(t *testing.T) {
+	base := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := base.Add(10 * time.Minute)
+	e := &Exits{now: func() time.Time { return now }}
+
+	e.Update([]Policy{
+		agingPolicy("1", "111.111.111.111", base),
+		agingPolicy("2", "222.222.222.222", base),
+	}, false)
+	if m := tminusOf(e); m["1"] != 0 || m["2"] != 0 {
+		t.Errorf("Got %v", m)
+	}
+
+	// an extra reload a few minutes later, exit 2 has dropped out but
+	// no time has passed
+	now = base.Add(15 * time.Minute)
+	e.Update([]Policy{agingPolicy("1", "111.111.111.111", base)}, true)
+	e.Update([]Policy{agingPolicy("1", "111.111.111.111", base)}, true)
+	if m := tminusOf(e); len(m) != 2 || m["1"] != 0 || m["2"] != 0 {
+		t.Errorf("Got %v, expected the extra reloads not to age anything", m)
+	}
+
+	// a couple of missed hourly runs
+	now = base.Add(3*time.Hour + 10*time.Minute)
+	e.Update([]Policy{agingPolicy("1", "111.111.111.111", base.Add(3*time.Hour))}, true)
+	if m := tminusOf(e); m["1"] != 0 || m["2"] != 3 {
+		t.Errorf("Got %v, expected exit 2 three hours old", m)
+	}
+	expectDump(t, e, "8.8.8.8", 80, "111.111.111.111", "222.222.222.222")
+
+	// the bulk list's window is in real hours
+	var buf bytes.Buffer
+	e.Dump(&buf, 2, "8.8.8.8", 80)
+	if buf.String() != "111.111.111.111\n" {
+		t.Errorf("Got %q", buf.String())
+	}
+
+	// and exit 2 is forgotten once it's past the longest window
+	now = base.Add(time.Duration(MaxTminus+1)*time.Hour + 10*time.Minute)
+	e.Update([]Policy{agingPolicy("1", "111.111.111.111", base.Add(time.Duration(MaxTminus+1)*time.Hour))}, true)
+	if m := tminusOf(e); len(m) != 1 || m["1"] != 0 {
+		t.Errorf("Got %v, expected exit 2 to have expired", m)
+	}
+	e.assertIsTor(t, "222.222.222.222", false)
+}
+
+// a relay that moves keeps running, but its old address ages and
+// expires on its own
+func TestAgingAddressMoves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotPath := path.Join(dir, "snapshot")
+
+	base := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := base.Add(10 * time.Minute)
+	clock := func() time.Time { return now }
+	e := &Exits{now: clock}
+	e.Update([]Policy{agingPolicy("A", "1.1.1.1", base)}, false)
+
+	var restarted *Exits
+	for h := 1; h <= 48; h++ {
+		now = base.Add(time.Duration(h)*time.Hour + 10*time.Minute)
+		e.Update([]Policy{agingPolicy("A", "2.2.2.2", base.Add(time.Duration(h)*time.Hour))}, true)
+
+		switch h {
+		case 16:
+			e.assertIsTor(t, "1.1.1.1", true)
+		case 17:
+			// past the window for IsTor, but still in a longer bulk list
+			e.assertIsTor(t, "1.1.1.1", false)
+			e.assertIsTor(t, "2.2.2.2", true)
+			expectDump(t, e, "8.8.8.8", 80, "2.2.2.2")
+			var buf bytes.Buffer
+			e.Dump(&buf, 20, "8.8.8.8", 80)
+			if buf.String() != "1.1.1.1\n2.2.2.2\n" {
+				t.Errorf("Got %q", buf.String())
+			}
+			if res := batchResult(e.Current(), "1.1.1.1", url.Values{}); res.IsTor {
+				t.Errorf("Got %+v for the address A moved from", res)
+			}
+
+			// the times survive a restart
+			if err = WriteSnapshot(snapshotPath, e.Current().Snapshot()); err != nil {
+				t.Fatal(err)
+			}
+			s, err := ReadSnapshot(snapshotPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			restarted = &Exits{now: clock}
+			restarted.Restore(s)
+		}
+		if h > 17 {
+			restarted.Update([]Policy{agingPolicy("A", "2.2.2.2", base.Add(time.Duration(h)*time.Hour))}, true)
+		}
+	}
+
+	for _, x := range []*Exits{e, restarted} {
+		x.assertIsTor(t, "1.1.1.1", false)
+		x.assertIsTor(t, "2.2.2.2", true)
+		if p := x.Policies(); len(p) != 1 || len(p[0].Address) != 1 || p[0].Address[0] != "2.2.2.2" || len(p[0].AddressSeen) != 1 {
+			t.Errorf("Got %+v, expected 1.1.1.1 to have expired", p)
+		}
+	}
+}
+
+func TestAgingExitAddresses(t *testing.T) {
+	base := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := base.Add(5 * time.Hour)
+
+	// TorDNSEL saw it exit after the consensus it was last in
+	exitAddresses := map[string][]ExitAddress{
+		"1": {{"111.111.111.112", base.Add(4 * time.Hour)}},
+	}
+	pl := mergePolicies(nil, []Policy{agingPolicy("1", "111.111.111.111", base)}, false, exitAddresses, now)
+	if len(pl) != 2 {
+		t.Fatalf("Got %+v", pl)
+	}
+	for _, pa := range pl {
+		if pa.Policy.Tminus != 1 || !pa.Policy.LastSeen.Equal(base.Add(4*time.Hour)) {
+			t.Errorf("Got %+v, expected it last seen by TorDNSEL", pa.Policy)
+		}
+	}
+}
+
+// staleness goes by the same clock as ageing
+func TestStaleClock(t *testing.T) {
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	e := &Exits{MaxAge: 3 * time.Hour, now: func() time.Time { return now }}
+	e.Update([]Policy{agingPolicy("1", "111.111.111.111", now)}, false)
+	if e.IsStale() {
+		t.Error("Didn't expect fresh data to be stale")
+	}
+
+	now = now.Add(4 * time.Hour)
+	if !e.IsStale() || !GetAdminStatus(e).Stale {
+		t.Error("Expected the data to be stale four hours on")
+	}
+	if w := serve(HealthHandler(e), "/health", "127.0.0.1:1234"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got %d from /health, expected it stale", w.Code)
+	}
+	if p := e.Policies()[0]; p.Tminus != 0 {
+		t.Errorf("Got Tminus %d, expected it as of the last reload", p.Tminus)
+	}
+}
+
+func TestReloadOldDataStaysStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policies := path.Join(dir, "exit-policies")
+
+	now := time.Now()
+	e := &Exits{MaxAge: 3 * time.Hour, now: func() time.Time { return now }}
+
+	// build-exits rerun on a consensus tor stopped updating
+	old := now.Add(-5 * time.Hour)
+	var buf bytes.Buffer
+	if err = WritePolicies(&buf, []Policy{agingPolicy("1", "111.111.111.111", old)}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(policies, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = e.Reload(policies, "", true); err != nil {
+			t.Fatal(err)
+		}
+		if !e.IsStale() {
+			t.Errorf("Reload %d made five hour old data fresh", i+1)
+		}
+	}
+
+	// exitips.py only has Tminus, as of when it wrote the file
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 80, "MaxPort": 80, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["222.222.222.222"], "Fingerprint": "2", "Tminus": 1}`
+	if err = ioutil.WriteFile(policies, []byte(testData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(policies, old, old); err != nil {
+		t.Fatal(err)
+	}
+	e = &Exits{MaxAge: 3 * time.Hour, now: func() time.Time { return now }}
+	if err = e.Reload(policies, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if !e.IsStale() {
+		t.Error("Expected an exit list written five hours ago to be stale")
+	}
+	if p := e.Policies()[0]; p.Tminus != 6 {
+		t.Errorf("Got Tminus %d, expected 6", p.Tminus)
+	}
+
+	// and fresh once the pipeline catches up
+	if err = os.Chtimes(policies, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Reload(policies, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if e.IsStale() {
+		t.Error("Didn't expect a freshly written exit list to be stale")
+	}
+}
+
+func TestAgingWithoutLastSeen(t *testing.T) {
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	// an exit list from before LastSeen was written
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 80, "MaxPort": 80, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1", "Tminus": 4}`
+	e := &Exits{now: func() time.Time { return now }}
+	if err := e.Load(strings.NewReader(testData), false); err != nil {
+		t.Fatal(err)
+	}
+	p := e.Policies()[0]
+	if p.Tminus != 4 || !p.LastSeen.Equal(now.Add(-4*time.Hour)) {
+		t.Errorf("Got %+v", p)
+	}
+
+	// and carries on ageing from there
+	now = now.Add(2 * time.Hour)
+	e.Update(nil, true)
+	if p = e.Policies()[0]; p.Tminus != 6 {
+		t.Errorf("Got Tminus %d, expected 6", p.Tminus)
+	}
+}
+
+func TestConcurrentReload(t *testing.T) {
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1"}
+	{"Rules": [{"IsAccept": true, "MinPort": 80, "MaxPort": 80, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["222.222.222.222"], "Fingerprint": "2"}`
+	exits := setupExitList(t, testData)
+
+	done := make(chan struct{})
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last uint64
+			buf := new(bytes.Buffer)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, ok := exits.IsTor("111.111.111.111"); !ok {
+					errs <- fmt.Errorf("111.111.111.111 should always be an exit")
+					return
+				}
+				d := exits.Current()
+				if d.Generation < last {
+					errs <- fmt.Errorf("generation went backwards, %d after %d", d.Generation, last)
+					return
+				}
+				last = d.Generation
+				buf.Reset()
+				d.DumpJSON(buf, 16, DefaultTarget.Address, DefaultTarget.Port)
+				if !strings.Contains(buf.String(), "111.111.111.111") {
+					errs <- fmt.Errorf("missing 111.111.111.111 from %s", buf)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := exits.Load(strings.NewReader(testData), i%2 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if g := exits.Current().Generation; g != 101 {
+		t.Errorf("Got generation %d, expected 101", g)
+	}
+}
+
+func TestReloadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policies := path.Join(dir, "exit-policies")
+
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1"}
+	{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["222.222.222.222"], "Fingerprint": "2"}`
+	if err = ioutil.WriteFile(policies, []byte(testData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exits := new(Exits)
+	if err = exits.Reload(policies, "", false); err != nil {
+		t.Fatal(err)
+	}
+	generation := exits.Current().Generation
+
+	bad := map[string]string{
+		"truncated":      testData[:len(testData)-20],
+		"empty":          "",
+		"bad address":    strings.Replace(testData, "222.222.222.222", "222.222.222", 1),
+		"bad port":       strings.Replace(testData, `"MaxPort": 443`, `"MaxPort": 70000`, 1),
+		"bad rule":       strings.Replace(testData, `"Address": null, "IsAddressWildcard": true`, `"Address": "nowhere"`, 1),
+		"no addresses":   strings.Replace(strings.Replace(testData, `["222.222.222.222"]`, `[]`, 1), `["111.111.111.111"]`, `[]`, 1),
+		"no fingerprint": strings.Replace(testData, `"Fingerprint": "2"`, `"Fingerprint": ""`, 1),
+	}
+	for name, data := range bad {
+		if err = ioutil.WriteFile(policies, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = exits.Reload(policies, "", true); err == nil {
+			t.Errorf("Expected an error reloading %s data", name)
+		}
+	}
+
+	if err = exits.Reload(path.Join(dir, "missing"), "", true); err == nil {
+		t.Error("Expected an error reloading a missing file")
+	}
+	if err = ioutil.WriteFile(policies, []byte(testData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = exits.Reload(policies, path.Join(dir, "missing"), true); err == nil {
+		t.Error("Expected an error reloading a missing exit list")
+	}
+
+	// still serving the first load
+	if g := exits.Current().Generation; g != generation {
+		t.Errorf("Got generation %d, expected %d", g, generation)
+	}
+	exits.assertIsTor(t, "111.111.111.111", true)
+	exits.assertIsTor(t, "222.222.222.222", true)
+
+	status := exits.ReloadStatus()
+	if status.Failures != len(bad)+2 {
+		t.Errorf("Got %d failures, expected %d", status.Failures, len(bad)+2)
+	}
+	if status.LastSuccess.IsZero() || status.LastFailure.Before(status.LastSuccess) {
+		t.Errorf("Unexpected reload times %+v", status)
+	}
+	if !strings.Contains(status.LastError, "missing") {
+		t.Errorf("Unexpected error %q", status.LastError)
+	}
+
+	// and recovers once the files are fixed
+	if err = exits.Reload(policies, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if status = exits.ReloadStatus(); !status.LastSuccess.After(status.LastFailure) {
+		t.Errorf("Unexpected reload times %+v", status)
+	}
+
+	// an exit without addresses, as exitips.py can write, is skipped
+	// rather than holding up the rest
+	noAddresses := strings.Replace(testData, `["222.222.222.222"]`, `[]`, 1)
+	if err = ioutil.WriteFile(policies, []byte(noAddresses), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = exits.Reload(policies, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(exits.Policies()); n != 1 {
+		t.Errorf("Got %d policies, expected 1", n)
+	}
+	exits.assertIsTor(t, "111.111.111.111", true)
+	exits.assertIsTor(t, "222.222.222.222", false)
+}
+
 func BenchmarkIsTor(b *testing.B) {
 	e := new(Exits)
-	e.LoadFromFile("data/exit-policies", false)
+	if err := e.LoadFromFile("data/exit-policies", false); err != nil {
+		b.Skip(err)
+	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		e.IsTor("91.121.43.80")
@@ -193,7 +600,9 @@ func BenchmarkIsTor(b *testing.B) {
 
 func BenchmarkDumpList(b *testing.B) {
 	e := new(Exits)
-	e.LoadFromFile("data/exit-policies", false)
+	if err := e.LoadFromFile("data/exit-policies", false); err != nil {
+		b.Skip(err)
+	}
 	buf := new(bytes.Buffer)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -201,3 +610,323 @@ func BenchmarkDumpList(b *testing.B) {
 		buf.Reset()
 	}
 }
+
+// the linear scan GetAllExits used to do, kept as a reference for the
+// index
+func scanAllExits(d *ExitData, ap AddressPort, tminus int) []string {
+	var exits []string
+	target := net.ParseIP(ap.Address)
+	for _, val := range d.List {
+		if target != nil && isIPv6(net.ParseIP(val.Address)) != isIPv6(target) {
+			continue
+		}
+		if val.Tminus <= tminus && val.Policy.CanExit(ap) {
+			exits = append(exits, val.Address+" "+val.Policy.Fingerprint)
+		}
+	}
+	return exits
+}
+
+func indexAllExits(d *ExitData, ap AddressPort, tminus int) []string {
+	var exits []string
+	d.GetAllExits(ap, tminus, func(address string, fingerprint string, _ int) {
+		exits = append(exits, address+" "+fingerprint)
+	})
+	return exits
+}
+
+// a made up but realistically sized exit list, some policies reject
+// private addresses like most real ones do
+// n exits, each address last seen up to a day ago on its own
+func syntheticExits(n int) *Exits {
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	r := rand.New(rand.NewSource(1))
+	ports := []int{22, 25, 53, 80, 110, 143, 194, 443, 465, 587, 993, 995, 5222, 6667, 8080, 8443, 9418}
+	var policies []Policy
+	for i := 0; i < n; i++ {
+		p := Policy{
+			Fingerprint: fmt.Sprintf("%040X", i),
+			Address:     []string{fmt.Sprintf("%d.%d.%d.%d", 1+r.Intn(223), r.Intn(256), r.Intn(256), 1+r.Intn(254))},
+		}
+		if r.Intn(4) == 0 {
+			p.Address = append(p.Address, fmt.Sprintf("2001:db8:%x::%x", r.Intn(65536), 1+r.Intn(65535)))
+		}
+		if r.Intn(4) == 0 {
+			p.Address = append(p.Address, fmt.Sprintf("%d.%d.%d.%d", 1+r.Intn(223), r.Intn(256), r.Intn(256), 1+r.Intn(254)))
+		}
+		p.AddressSeen = make(map[string]time.Time)
+		for _, a := range p.Address {
+			seen := now.Add(-time.Duration(r.Intn(20)) * time.Hour)
+			p.AddressSeen[a] = seen
+			if seen.After(p.LastSeen) {
+				p.LastSeen = seen
+			}
+		}
+		if r.Intn(2) == 0 {
+			for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"} {
+				ip, ipNet, _ := net.ParseCIDR(cidr)
+				p.Rules = append(p.Rules, Rule{IP: ip, IPNet: ipNet, MinPort: 0, MaxPort: 65535})
+			}
+		}
+		if r.Intn(4) == 0 {
+			ip, ipNet, _ := net.ParseCIDR("38.229.0.0/16")
+			p.Rules = append(p.Rules, Rule{IsAccept: r.Intn(2) == 0, IP: ip, IPNet: ipNet, MinPort: 80, MaxPort: 443})
+		}
+		switch r.Intn(3) {
+		case 0:
+			// reduced exit
+			for _, port := range ports {
+				if r.Intn(4) > 0 {
+					p.Rules = append(p.Rules, Rule{IsAccept: true, IsAddressWildcard: true, MinPort: port, MaxPort: port})
+				}
+			}
+		case 1:
+			// default accept with a few holes
+			p.IsAllowedDefault = true
+			for j := 0; j < 3; j++ {
+				min := r.Intn(65000)
+				p.Rules = append(p.Rules, Rule{IsAddressWildcard: true, MinPort: min, MaxPort: min + r.Intn(500)})
+			}
+		default:
+			p.Rules = append(p.Rules,
+				Rule{IsAddressWildcard: true, MinPort: 25, MaxPort: 25},
+				Rule{IsAccept: true, IsAddressWildcard: true, MinPort: 1, MaxPort: 1024},
+				Rule{IsAccept: true, IsAddressWildcard: true, MinPort: 8000, MaxPort: 9000})
+		}
+		policies = append(policies, p)
+	}
+	e := &Exits{now: func() time.Time { return now }}
+	e.Update(policies, false)
+	return e
+}
+
+func TestIndexMatchesScan(t *testing.T) {
+	d := syntheticExits(500).Current()
+
+	// relays whose addresses were last seen at different times, so the
+	// scan and index have to age each address on its own
+	ages := make(map[string]map[int]bool)
+	for _, val := range d.List {
+		if ages[val.Policy.Fingerprint] == nil {
+			ages[val.Policy.Fingerprint] = make(map[int]bool)
+		}
+		ages[val.Policy.Fingerprint][val.Tminus] = true
+	}
+	mixed := 0
+	for _, tminuses := range ages {
+		if len(tminuses) > 1 {
+			mixed += 1
+		}
+	}
+	if mixed == 0 {
+		t.Fatal("Expected relays with addresses of different ages")
+	}
+	targets := []AddressPort{
+		DefaultTarget,
+		{"10.1.2.3", 80},
+		{"38.229.70.31", 443},
+		{"192.168.1.1", 25},
+		{"2001:db8::1", 8443},
+		{"not an address", 80},
+		{"1.2.3.4", 0},
+		{"1.2.3.4", 65535},
+		{"1.2.3.4", 70000},
+	}
+	for port := 0; port < 10000; port += 97 {
+		targets = append(targets, AddressPort{"123.123.123.123", port})
+	}
+	for _, ap := range targets {
+		for _, tminus := range []int{0, 5, 16, 100} {
+			scanned, indexed := scanAllExits(d, ap, tminus), indexAllExits(d, ap, tminus)
+			if strings.Join(scanned, ",") != strings.Join(indexed, ",") {
+				t.Errorf("%v in the past %d hours: scan found %d exits, index %d", ap, tminus, len(scanned), len(indexed))
+			}
+		}
+	}
+
+	// IsTor agrees with the list it used to be computed from
+	tor := make(map[string]string)
+	for _, target := range []AddressPort{DefaultTarget, DefaultTarget6} {
+		for _, exit := range scanAllExits(d, target, 16) {
+			parts := strings.Fields(exit)
+			tor[parts[0]] = parts[1]
+		}
+	}
+	for _, val := range d.List {
+		_, expected := tor[val.Address]
+		if _, ok := d.IsTor(val.Address); ok != expected {
+			t.Errorf("Got IsTor %v for %s, expected %v", ok, val.Address, expected)
+		}
+	}
+	if n := len(d.TorAddresses()); n != len(tor) {
+		t.Errorf("Got %d tor addresses, expected %d", n, len(tor))
+	}
+}
+
+func TestCompilePolicy(t *testing.T) {
+	p := Policy{
+		Rules: []Rule{
+			{IsAddressWildcard: true, MinPort: 25, MaxPort: 25},
+			{IsAccept: true, IsAddressWildcard: true, MinPort: 20, MaxPort: 30},
+			{IsAddressWildcard: true, MinPort: 100, MaxPort: 200},
+		},
+		IsAllowedDefault: true,
+	}
+	c := compilePolicy(&p)
+	if len(c.steps) != 1 {
+		t.Fatalf("Got %d steps, expected 1", len(c.steps))
+	}
+	expected := portRanges{{0, 24}, {26, 99}, {201, 65535}}
+	if fmt.Sprint(c.steps[0].accepted) != fmt.Sprint(expected) {
+		t.Errorf("Got ports %v, expected %v", c.steps[0].accepted, expected)
+	}
+
+	// reject 1.2.3.4:80 goes between the wildcard rules
+	rule := Rule{IP: net.ParseIP("1.2.3.4"), MinPort: 80, MaxPort: 80}
+	p.Rules = append(p.Rules[:2], append([]Rule{rule}, p.Rules[2:]...)...)
+	p.IsAllowedDefault = false
+	if c = compilePolicy(&p); len(c.steps) != 2 {
+		t.Fatalf("Got %d steps, expected 2", len(c.steps))
+	}
+	if fmt.Sprint(c.steps[0].decided) != "[{20 30}]" || fmt.Sprint(c.steps[1].accepted) != "[]" {
+		t.Errorf("Unexpected steps %+v", c.steps)
+	}
+	cases := []struct {
+		ip       string
+		port     int
+		expected bool
+	}{
+		{"1.2.3.4", 25, false},
+		{"1.2.3.4", 22, true},
+		{"1.2.3.4", 80, false},
+		{"1.2.3.5", 80, false},
+		{"1.2.3.4", 150, false},
+		{"1.2.3.4", 8080, false},
+	}
+	for _, x := range cases {
+		if c.CanExit(net.ParseIP(x.ip), x.port) != x.expected {
+			t.Errorf("Expected %v for %s:%d", x.expected, x.ip, x.port)
+		}
+	}
+	p.IsAllowedDefault = true
+	c = compilePolicy(&p)
+	if c.CanExit(net.ParseIP("1.2.3.4"), 80) || !c.CanExit(net.ParseIP("1.2.3.5"), 80) {
+		t.Error("Address rule not applied")
+	}
+	if c.CanExit(net.ParseIP("1.2.3.5"), 150) || !c.CanExit(net.ParseIP("1.2.3.5"), 8080) {
+		t.Error("Wildcard rules after the address rule not applied")
+	}
+}
+
+func benchmarkData(b *testing.B) *ExitData {
+	e := new(Exits)
+	if err := e.LoadFromFile("data/exit-policies", false); err != nil {
+		e = syntheticExits(2000)
+	}
+	b.ResetTimer()
+	return e.Current()
+}
+
+func BenchmarkBulkIndexed(b *testing.B) {
+	d := benchmarkData(b)
+	for i := 0; i < b.N; i++ {
+		d.GetAllExits(AddressPort{"38.229.70.31", 8080}, 16, func(string, string, int) {})
+	}
+}
+
+func BenchmarkBulkScan(b *testing.B) {
+	d := benchmarkData(b)
+	for i := 0; i < b.N; i++ {
+		scanAllExits(d, AddressPort{"38.229.70.31", 8080}, 16)
+	}
+}
+
+func BenchmarkIsTorIndexed(b *testing.B) {
+	d := benchmarkData(b)
+	exit := d.List[len(d.List)/2].Address
+	for i := 0; i < b.N; i++ {
+		d.IsTor(exit)
+		d.IsTor("91.121.43.4")
+	}
+}
+
+// the string map IsTor used to precompute
+func BenchmarkIsTorMap(b *testing.B) {
+	d := benchmarkData(b)
+	exit := d.List[len(d.List)/2].Address
+	lookup := make(map[string]string)
+	for _, e := range scanAllExits(d, DefaultTarget, 16) {
+		parts := strings.Fields(e)
+		lookup[parts[0]] = parts[1]
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = lookup[exit]
+		_ = lookup["91.121.43.4"]
+	}
+}
+
+func BenchmarkBulkCached(b *testing.B) {
+	d := benchmarkData(b)
+	buf := new(bytes.Buffer)
+	for i := 0; i < b.N; i++ {
+		d.DumpJSON(buf, 16, "38.229.70.31", 8080)
+		buf.Reset()
+	}
+}
+
+func TestIPv6Exits(t *testing.T) {
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": "::", "Mask": "::"}, {"IsAccept": false, "MinPort": 1, "MaxPort": 65535, "Address": "::", "Mask": "::"}, {"IsAccept": true, "MinPort": 80, "MaxPort": 80, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111", "2001:0DB8:0000::0001"], "Fingerprint": "1"}
+	{"Rules": [{"IsAccept": false, "MinPort": 1, "MaxPort": 65535, "Address": "::", "Mask": "::"}, {"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["222.222.222.222", "2001:db8::2"], "Fingerprint": "2"}`
+	exits := setupExitList(t, testData)
+
+	// addresses are stored and looked up in canonical form
+	for _, addr := range []string{"2001:db8::1", "2001:0db8::0001", "2001:DB8:0:0:0:0:0:1"} {
+		if fingerprint, ok := exits.IsTor(addr); !ok || fingerprint != "1" {
+			t.Errorf("Got %s, %v for %s", fingerprint, ok, addr)
+		}
+	}
+	// 2 only exits to ipv4, so its ipv6 address doesn't count
+	exits.assertIsTor(t, "2001:db8::2", false)
+	exits.assertIsTor(t, "222.222.222.222", true)
+	// and 1 only exits to ipv6 on 443
+	exits.assertIsTor(t, "111.111.111.111", false)
+	exits.assertIsTor(t, "::ffff:222.222.222.222", true)
+
+	expectDump(t, exits, "2001:db8:4::1", 443, "2001:db8::1")
+	expectDump(t, exits, "2001:db8:4::1", 80)
+	expectDump(t, exits, "38.229.70.31", 80, "111.111.111.111")
+	expectDump(t, exits, "38.229.70.31", 443, "222.222.222.222")
+
+	addrs := exits.Current().TorAddresses()
+	if len(addrs) != 2 || addrs[0] != "2001:db8::1" || addrs[1] != "222.222.222.222" {
+		t.Errorf("Got tor addresses %v", addrs)
+	}
+}
+
+func TestIsTorEquivalentForms(t *testing.T) {
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": "::", "Mask": "::"}, {"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["001.002.003.004", "::ffff:5.6.7.8", "2001:DB8::1", "fe80::1"], "Fingerprint": "1"}`
+	exits := setupExitList(t, testData)
+	tests := map[string]bool{
+		"1.2.3.4":                 true,
+		"::ffff:1.2.3.4":          true,
+		"01.2.3.04":               true,
+		"5.6.7.8":                 true,
+		"::ffff:5.6.7.8":          true,
+		"2001:db8::1":             true,
+		"2001:0db8:0:0:0:0:0:1":   true,
+		"[2001:db8::1]":           true,
+		"fe80::1%eth0":            true,
+		"1.2.3.5":                 false,
+		"::1.2.3.4":               false,
+		"2001:db8::2":             false,
+		"not an address":          false,
+		"":                        false,
+		"0:0:0:0:0:ffff:5.6.7.08": true,
+	}
+	for addr, expected := range tests {
+		exits.assertIsTor(t, addr, expected)
+	}
+	// and they're stored canonically
+	expectDump(t, exits, "38.229.70.31", 443, "1.2.3.4", "5.6.7.8")
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ServerDescriptor struct {
+	Nickname         string
+	Fingerprint      string
+	Address          string
+	ORAddresses      []string
+	Published        time.Time
+	ExitPolicy       []Rule
+	IsAllowedDefault bool
+	IPv6Policy       []Rule
+}
+
+func isIPv6Rule(r Rule) bool {
+	return !r.IsAddressWildcard && strings.Contains(r.Address, ":")
+}
+
+// rules that only match ipv6 come first since the ipv4 policy usually
+// ends with reject *:*. the policy's own ipv6 rules are the precise ones,
+// then the ipv6-policy summary covers the rest of ipv6. without one the
+// relay doesn't exit to ipv6, bar the ipv6 rules in its policy, and the
+// wildcards in the policy only apply to ipv4. each rule is emitted once
+func (d ServerDescriptor) Rules() []Rule {
+	rules := make([]Rule, 0, len(d.IPv6Policy)+len(d.ExitPolicy)+1)
+	var rest []Rule
+	for _, r := range d.ExitPolicy {
+		if isIPv6Rule(r) {
+			rules = append(rules, r)
+		} else {
+			rest = append(rest, r)
+		}
+	}
+	if len(d.IPv6Policy) > 0 {
+		rules = append(rules, d.IPv6Policy...)
+	} else {
+		reject := Rule{IsAccept: false, Address: "::", Mask: "::", MinPort: 1, MaxPort: 65535}
+		reject.resolveAddress()
+		rules = append(rules, reject)
+	}
+	return append(rules, rest...)
+}
+
+// the ipv6 addresses it listens on, if it exits to ipv6 they're the
+// ones its connections come from
+func (d ServerDescriptor) IPv6Addresses() []string {
+	var addrs []string
+	for _, a := range d.ORAddresses {
+		if strings.Contains(a, ":") {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+func (d ServerDescriptor) IsExitingAllowed() bool {
+	return IsExitingAllowed(d.ExitPolicy, d.IsAllowedDefault)
+}
+
+// parses the addrspec of an exitpattern, scoping wildcards to ipv6
+// when ipv6Only is set (accept6/reject6 lines)
+func parseAddrSpec(spec string, ipv6Only bool) (r Rule, err error) {
+	switch spec {
+	case "*":
+		if ipv6Only {
+			r.Address, r.Mask = "::", "::"
+		} else {
+			r.IsAddressWildcard = true
+		}
+		return
+	case "*4":
+		if ipv6Only {
+			return r, fmt.Errorf("ipv4 address %q in ipv6 rule", spec)
+		}
+		r.Address, r.Mask = "0.0.0.0", "0.0.0.0"
+		return
+	case "*6":
+		r.Address, r.Mask = "::", "::"
+		return
+	}
+
+	addr, mask := spec, ""
+	if i := strings.Index(spec, "/"); i >= 0 {
+		addr, mask = spec[:i], spec[i+1:]
+	}
+
+	isIPv6 := strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]")
+	if isIPv6 {
+		addr = addr[1 : len(addr)-1]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil || isIPv6 == (ip.To4() != nil) {
+		return r, fmt.Errorf("invalid address %q", spec)
+	}
+	if ipv6Only && !isIPv6 {
+		return r, fmt.Errorf("ipv4 address %q in ipv6 rule", spec)
+	}
+	r.Address = addr
+
+	bits := 8 * len(ip.To4())
+	if isIPv6 {
+		bits = 8 * net.IPv6len
+	}
+
+	if len(mask) > 0 {
+		var m net.IPMask
+		if n, err := strconv.Atoi(mask); err == nil {
+			if n < 0 || n > bits {
+				return r, fmt.Errorf("invalid mask %q", spec)
+			}
+			m = net.CIDRMask(n, bits)
+		} else if mip := net.ParseIP(mask).To4(); mip != nil && !isIPv6 {
+			m = net.IPMask(mip)
+		} else {
+			return r, fmt.Errorf("invalid mask %q", spec)
+		}
+		// like exitips.py, host masks are left empty
+		if ones, size := m.Size(); ones != size || size == 0 {
+			r.Mask = net.IP(m).String()
+		}
+	}
+
+	return
+}
+
+// parses an "accept|reject[6] exitpattern" line from a descriptor
+func ParseExitPattern(keyword string, pattern string) (r Rule, err error) {
+	switch keyword {
+	case "accept", "accept6":
+		r.IsAccept = true
+	case "reject", "reject6":
+		r.IsAccept = false
+	default:
+		return r, fmt.Errorf("invalid exit policy keyword %q", keyword)
+	}
+
+	i := strings.LastIndex(pattern, ":")
+	if i < 0 {
+		return r, fmt.Errorf("invalid exit pattern %q", pattern)
+	}
+
+	addr, err := parseAddrSpec(pattern[:i], strings.HasSuffix(keyword, "6"))
+	if err != nil {
+		return r, err
+	}
+	r.IsAddressWildcard, r.Address, r.Mask = addr.IsAddressWildcard, addr.Address, addr.Mask
+	r.resolveAddress()
+
+	r.MinPort, r.MaxPort, err = ParsePortRange(pattern[i+1:])
+	return
+}
+
+// turns the ipv6-policy summary into rules that only match ipv6
+// addresses, finishing with the implied catch-all. nothing is returned
+// for relays that don't exit to ipv6 at all
+func ipv6PolicyRules(summary string) ([]Rule, error) {
+	rules, isAllowedDefault, err := ParsePolicySummary(summary)
+	if err != nil || !IsExitingAllowed(rules, isAllowedDefault) {
+		return nil, err
+	}
+	rules = append(rules, Rule{IsAccept: isAllowedDefault, MinPort: 1, MaxPort: 65535})
+	for i := range rules {
+		rules[i].IsAddressWildcard = false
+		rules[i].Address, rules[i].Mask = "::", "::"
+		rules[i].resolveAddress()
+	}
+	return rules, nil
+}
+
+func finishDescriptor(d *ServerDescriptor, done bool) error {
+	if len(d.Fingerprint) == 0 {
+		return fmt.Errorf("descriptor for %s is missing a fingerprint", d.Nickname)
+	}
+	if !done {
+		// if no rule matches, the address will be accepted
+		d.IsAllowedDefault = true
+	}
+	return nil
+}
+
+// parses a stream of server-descriptor 1.0 documents, such as tor's
+// cached-descriptors file
+func ParseServerDescriptors(source io.Reader) ([]ServerDescriptor, error) {
+	var (
+		descs    []ServerDescriptor
+		d        *ServerDescriptor
+		inObject bool
+		done     bool
+		lineNo   int
+	)
+
+	scanner := bufio.NewScanner(source)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		lineNo += 1
+		line := scanner.Text()
+
+		// skip over keys, certificates and signatures
+		if inObject {
+			inObject = !strings.HasPrefix(line, "-----END ")
+			continue
+		}
+		if strings.HasPrefix(line, "-----BEGIN ") {
+			inObject = true
+			continue
+		}
+
+		if len(line) == 0 || strings.HasPrefix(line, "@") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		keyword, args := fields[0], fields[1:]
+
+		if keyword == "router" {
+			if d != nil {
+				if err := finishDescriptor(d, done); err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNo, err)
+				}
+			}
+			// nickname address ORPort SOCKSPort DirPort
+			if len(args) < 5 || net.ParseIP(args[1]).To4() == nil {
+				return nil, fmt.Errorf("line %d: invalid router line: %q", lineNo, line)
+			}
+			descs = append(descs, ServerDescriptor{Nickname: args[0], Address: args[1]})
+			d = &descs[len(descs)-1]
+			done = false
+			continue
+		}
+
+		if d == nil {
+			return nil, fmt.Errorf("line %d: expected a router line", lineNo)
+		}
+
+		var err error
+		switch keyword {
+		case "fingerprint":
+			d.Fingerprint = strings.ToUpper(strings.Join(args, ""))
+			if len(d.Fingerprint) != 40 {
+				err = fmt.Errorf("invalid fingerprint %q", strings.Join(args, " "))
+			}
+		case "published":
+			d.Published, err = time.Parse(DirTimeFormat, strings.Join(args, " "))
+		case "accept", "reject", "accept6", "reject6":
+			var r Rule
+			if len(args) != 1 {
+				err = fmt.Errorf("invalid exit policy line %q", line)
+			} else if r, err = ParseExitPattern(keyword, args[0]); err == nil && !done {
+				// like stem, stop at the first catch-all rule
+				d.ExitPolicy = append(d.ExitPolicy, r)
+				if r.IsAddressWildcard && IsPortWildcard(r) {
+					d.IsAllowedDefault = r.IsAccept
+					done = true
+				}
+			}
+		case "or-address":
+			var a string
+			if len(args) != 1 {
+				err = fmt.Errorf("invalid or-address line %q", line)
+			} else if a, err = parseORAddress(args[0]); err == nil {
+				InsertUnique(&d.ORAddresses, a)
+			}
+		case "ipv6-policy":
+			d.IPv6Policy, err = ipv6PolicyRules(strings.Join(args, " "))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if d != nil {
+		if err := finishDescriptor(d, done); err != nil {
+			return nil, err
+		}
+	}
+
+	return descs, nil
+}
+
+func ParseServerDescriptorsFile(filePath string) ([]ServerDescriptor, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	descs, err := ParseServerDescriptors(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	return descs, nil
+}
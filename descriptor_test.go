@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadDescriptors(t *testing.T) map[string]ServerDescriptor {
+	descs, err := ParseServerDescriptorsFile("testdata/cached-descriptors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]ServerDescriptor)
+	for _, d := range descs {
+		// keep the latest, like tor does
+		if q, ok := m[d.Nickname]; !ok || d.Published.After(q.Published) {
+			m[d.Nickname] = d
+		}
+	}
+	return m
+}
+
+func TestParseServerDescriptors(t *testing.T) {
+	descs, err := ParseServerDescriptorsFile("testdata/cached-descriptors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != 5 {
+		t.Fatalf("Got %d descriptors, expected 5", len(descs))
+	}
+
+	d := descs[0]
+	if d.Nickname != "exit1" || d.Address != "91.121.43.80" {
+		t.Errorf("Unexpected router line %s %s", d.Nickname, d.Address)
+	}
+	if d.Fingerprint != "C1032C7046EF1D28E5D6D3EE402C21B0036EC52F" {
+		t.Errorf("Got fingerprint %s", d.Fingerprint)
+	}
+	if expected := time.Date(2019, 1, 1, 6, 51, 16, 0, time.UTC); !d.Published.Equal(expected) {
+		t.Errorf("Got published %v, expected %v", d.Published, expected)
+	}
+	// the policy inside the certificate is ignored
+	if len(d.ExitPolicy) != 15 {
+		t.Errorf("Got %d rules, expected 15", len(d.ExitPolicy))
+	}
+	if d.IsAllowedDefault || !d.IsExitingAllowed() {
+		t.Error("exit1 should be an exit that rejects by default")
+	}
+
+	r := d.ExitPolicy[0]
+	if r.IsAccept || r.IsAddressWildcard || r.Address != "0.0.0.0" || r.Mask != "255.0.0.0" || r.MinPort != 1 || r.MaxPort != 65535 {
+		t.Errorf("Unexpected masked rule %+v", r)
+	}
+	r = d.ExitPolicy[6]
+	if r.Address != "91.121.43.80" || r.Mask != "" {
+		t.Errorf("Unexpected host rule %+v", r)
+	}
+}
+
+func TestParseServerDescriptorsBlankLines(t *testing.T) {
+	descs, err := ParseServerDescriptors(strings.NewReader(withBlankLines(t, "testdata/cached-descriptors")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ParseServerDescriptorsFile("testdata/cached-descriptors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(descs, expected) {
+		t.Errorf("Got %+v, expected %+v", descs, expected)
+	}
+}
+
+func TestDescriptorPolicies(t *testing.T) {
+	m := loadDescriptors(t)
+
+	// stops at the first catch-all
+	d := m["exit3"]
+	if len(d.ExitPolicy) != 4 {
+		t.Errorf("Got %d rules for exit3, expected 4", len(d.ExitPolicy))
+	}
+	if r := d.ExitPolicy[0]; r.Address != "2001:db8:3::" || r.Mask != "ffff:ffff:ffff::" || !r.IsAccept {
+		t.Errorf("Unexpected accept6 rule %+v", r)
+	}
+	if r := d.ExitPolicy[1]; r.Address != "51.15.43.0" || r.Mask != "255.255.255.0" {
+		t.Errorf("Unexpected dotted mask rule %+v", r)
+	}
+
+	// the policy's ipv6 rules come once, ahead of the catch-all
+	expectRules(t, "exit3", d.Rules(),
+		"accept 2001:db8:3::/48:443-443",
+		"reject ::/0:1-65535",
+		"reject 51.15.43.0/24:1-65535",
+		"accept *:443-443",
+		"reject *:1-65535")
+
+	// then the ipv6-policy summary, which doesn't override them
+	d = m["exit2"]
+	if !d.IsAllowedDefault {
+		t.Error("exit2 should accept by default")
+	}
+	if len(d.IPv6Policy) != 3 {
+		t.Fatalf("Got %d ipv6 rules, expected 3", len(d.IPv6Policy))
+	}
+	expectRules(t, "exit2", d.Rules(),
+		"reject 2001:db8::/32:1-65535",
+		"accept ::/0:80-80",
+		"accept ::/0:443-443",
+		"reject ::/0:1-65535",
+		"reject 0.0.0.0/8:1-65535",
+		"reject 169.254.0.0/16:1-65535",
+		"reject 127.0.0.0/8:1-65535",
+		"reject 192.168.0.0/16:1-65535",
+		"reject 10.0.0.0/8:1-65535",
+		"reject 172.16.0.0/12:1-65535",
+		"reject 83.227.52.198:1-65535",
+		"reject *:25-25",
+		"reject *:119-119",
+		"reject *:135-139",
+		"reject *:445-445",
+		"accept *:1-65535")
+
+	if m["middle1"].IsExitingAllowed() {
+		t.Error("middle1 shouldn't allow exiting")
+	}
+}
+
+func expectRules(t *testing.T, name string, rules []Rule, expected ...string) {
+	got := make([]string, len(rules))
+	for i, r := range rules {
+		got[i] = r.String()
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Got rules for %s:\n%s\nexpected:\n%s", name, strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func descriptorExits(t *testing.T, names ...string) *Exits {
+	m := loadDescriptors(t)
+	var data []string
+	for _, name := range names {
+		d := m[name]
+		p := Policy{
+			Fingerprint:      d.Fingerprint,
+			Address:          append([]string{d.Address}, d.IPv6Addresses()...),
+			Rules:            d.Rules(),
+			IsAllowedDefault: d.IsAllowedDefault,
+		}
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, string(b))
+	}
+	return setupExitList(t, strings.Join(data, "\n"))
+}
+
+func TestDescriptorRulesMatch(t *testing.T) {
+	exits := descriptorExits(t, "exit1", "exit2", "exit3")
+
+	// private ranges are rejected
+	expectDump(t, exits, "10.1.2.3", 80)
+	expectDump(t, exits, "172.20.0.1", 443, "51.15.43.205")
+	// exit1 rejects port 25 to a single host
+	expectDump(t, exits, "38.229.70.31", 25)
+	expectDump(t, exits, "38.229.70.32", 80, "91.121.43.80", "83.227.52.198")
+	// exit3 rejects its own /24
+	expectDump(t, exits, "51.15.43.1", 443, "91.121.43.80", "83.227.52.198")
+	expectDump(t, exits, "51.15.44.1", 443, "91.121.43.80", "83.227.52.198", "51.15.43.205")
+
+	// ipv6 targets
+	exits = descriptorExits(t, "exit2", "exit3")
+	expectDump(t, exits, "2001:db8:3::1", 443, "2001:db8:3::1")
+	expectDump(t, exits, "2001:db8:3::1", 80)
+	// exit2's policy rejects 2001:db8::/32 whatever its summary says
+	expectDump(t, exits, "2001:db8:4::1", 80)
+	expectDump(t, exits, "2001:db9::1", 80, "2001:db8:2::1")
+	expectDump(t, exits, "2001:db9::1", 22)
+	// only exit addresses of the target's family are listed
+	expectDump(t, exits, "51.15.44.1", 443, "83.227.52.198", "51.15.43.205")
+
+	// exit1 doesn't exit to ipv6 at all, its wildcards are ipv4 only
+	exit1 := loadDescriptors(t)["exit1"]
+	p := Policy{Rules: exit1.Rules(), IsAllowedDefault: exit1.IsAllowedDefault}
+	if p.CanExit(AddressPort{"2001:db8:4::1", 443}) || !p.CanExit(AddressPort{"51.15.44.1", 443}) {
+		t.Error("exit1's wildcards should only apply to ipv4")
+	}
+}
+
+func TestParseExitPatternErrors(t *testing.T) {
+	tests := [][2]string{
+		{"accept", "*"},
+		{"accept", "1.2.3.4:0-"},
+		{"accept", "1.2.3.4/33:*"},
+		{"accept", "1.2.3:*"},
+		{"accept", "2001:db8::1:*"},
+		{"accept6", "1.2.3.4:80"},
+		{"accept6", "*4:80"},
+		{"allow", "*:*"},
+	}
+	for _, test := range tests {
+		if r, err := ParseExitPattern(test[0], test[1]); err == nil {
+			t.Errorf("Expected an error for %s %s, got %+v", test[0], test[1], r)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// only keep exit addresses observed this close to the latest observation
+var ExitAddressMaxAge = 24 * time.Hour
+
+type ExitAddress struct {
+	Address string
+	Time    time.Time
+}
+
+type ExitListEntry struct {
+	Fingerprint   string
+	Published     time.Time
+	LastStatus    time.Time
+	ExitAddresses []ExitAddress
+}
+
+// parses a tordnsel 1.0 exit list, either as archived by CollecTor or
+// TorDNSEL's exit-addresses state file
+func ParseExitList(source io.Reader) ([]ExitListEntry, error) {
+	var (
+		entries []ExitListEntry
+		entry   *ExitListEntry
+		lineNo  int
+	)
+
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		lineNo += 1
+		line := scanner.Text()
+
+		if len(line) == 0 || strings.HasPrefix(line, "@") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		keyword, args := fields[0], fields[1:]
+
+		if keyword == "ExitNode" {
+			if len(args) != 1 || len(args[0]) != 40 {
+				return nil, fmt.Errorf("line %d: invalid ExitNode line: %q", lineNo, line)
+			}
+			entries = append(entries, ExitListEntry{Fingerprint: strings.ToUpper(args[0])})
+			entry = &entries[len(entries)-1]
+			continue
+		}
+
+		var err error
+		switch keyword {
+		case "Published":
+			if entry != nil {
+				entry.Published, err = time.Parse(DirTimeFormat, strings.Join(args, " "))
+			}
+		case "LastStatus":
+			if entry != nil {
+				entry.LastStatus, err = time.Parse(DirTimeFormat, strings.Join(args, " "))
+			}
+		case "ExitAddress":
+			if entry == nil || len(args) != 3 || net.ParseIP(args[0]) == nil {
+				err = fmt.Errorf("invalid ExitAddress line: %q", line)
+				break
+			}
+			var t time.Time
+			if t, err = time.Parse(DirTimeFormat, args[1]+" "+args[2]); err == nil {
+				entry.ExitAddresses = append(entry.ExitAddresses, ExitAddress{args[0], t})
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func ParseExitListFile(filePath string) ([]ExitListEntry, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries, err := ParseExitList(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	return entries, nil
+}
+
+// merges the observations in entries with those in addrs, keeping the
+// latest time per address and dropping anything older than
+// ExitAddressMaxAge before the newest observation
+func MergeExitAddresses(addrs map[string][]ExitAddress, entries []ExitListEntry) map[string][]ExitAddress {
+	latest := make(map[string]map[string]time.Time)
+	var newest time.Time
+
+	add := func(fingerprint string, a ExitAddress) {
+		seen, ok := latest[fingerprint]
+		if !ok {
+			seen = make(map[string]time.Time)
+			latest[fingerprint] = seen
+		}
+		if t, ok := seen[a.Address]; !ok || a.Time.After(t) {
+			seen[a.Address] = a.Time
+		}
+		if a.Time.After(newest) {
+			newest = a.Time
+		}
+	}
+
+	for fingerprint, as := range addrs {
+		for _, a := range as {
+			add(fingerprint, a)
+		}
+	}
+	for _, entry := range entries {
+		for _, a := range entry.ExitAddresses {
+			add(entry.Fingerprint, a)
+		}
+	}
+
+	merged := make(map[string][]ExitAddress, len(latest))
+	for fingerprint, seen := range latest {
+		var as []ExitAddress
+		for address, t := range seen {
+			if newest.Sub(t) <= ExitAddressMaxAge {
+				as = append(as, ExitAddress{address, t})
+			}
+		}
+		if len(as) > 0 {
+			sort.Slice(as, func(i, j int) bool { return as[i].Address < as[j].Address })
+			merged[fingerprint] = as
+		}
+	}
+	return merged
+}
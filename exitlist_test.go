@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExitList(t *testing.T) {
+	entries, err := ParseExitListFile("testdata/exit-lists/2019-01-01-12-02-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Got %d entries, expected 4", len(entries))
+	}
+
+	e := entries[2]
+	if e.Fingerprint != "0FDAF05AFE26B9D620AF4186609389B0974FD597" {
+		t.Errorf("Got fingerprint %s", e.Fingerprint)
+	}
+	if expected := time.Date(2019, 1, 1, 3, 12, 44, 0, time.UTC); !e.Published.Equal(expected) {
+		t.Errorf("Got published %v, expected %v", e.Published, expected)
+	}
+	if len(e.ExitAddresses) != 2 {
+		t.Fatalf("Got %d exit addresses, expected 2", len(e.ExitAddresses))
+	}
+	a := e.ExitAddresses[1]
+	if a.Address != "51.15.43.207" || !a.Time.Equal(time.Date(2019, 1, 1, 9, 51, 30, 0, time.UTC)) {
+		t.Errorf("Unexpected exit address %+v", a)
+	}
+
+	// the state file has no header
+	state := "ExitNode C1032C7046EF1D28E5D6D3EE402C21B0036EC52F\nPublished 2019-01-01 06:51:16\nLastStatus 2019-01-01 11:03:11\nExitAddress 91.121.43.81 2019-01-01 11:08:48\n"
+	if entries, err = ParseExitList(strings.NewReader(state)); err != nil || len(entries) != 1 {
+		t.Errorf("Failed to parse state file: %v", err)
+	}
+
+	bad := []string{
+		"ExitNode 1234\n",
+		"ExitAddress 91.121.43.81 2019-01-01 11:08:48\n",
+		"ExitNode C1032C7046EF1D28E5D6D3EE402C21B0036EC52F\nExitAddress 91.121.43 2019-01-01 11:08:48\n",
+		"ExitNode C1032C7046EF1D28E5D6D3EE402C21B0036EC52F\nExitAddress 91.121.43.81 yesterday\n",
+	}
+	for _, doc := range bad {
+		if _, err := ParseExitList(strings.NewReader(doc)); err == nil {
+			t.Errorf("Expected an error parsing %q", doc)
+		}
+	}
+}
+
+func TestParseExitListBlankLines(t *testing.T) {
+	filePath := "testdata/exit-lists/2019-01-01-12-02-01"
+	entries, err := ParseExitList(strings.NewReader(withBlankLines(t, filePath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ParseExitListFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Got %+v, expected %+v", entries, expected)
+	}
+}
+
+func TestMergeExitAddresses(t *testing.T) {
+	entries, err := ParseExitListFile("testdata/exit-lists/2019-01-01-12-02-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := MergeExitAddresses(nil, entries)
+
+	// stale observations are dropped
+	if as := m["0FDAF05AFE26B9D620AF4186609389B0974FD597"]; len(as) != 1 || as[0].Address != "51.15.43.207" {
+		t.Errorf("Unexpected addresses %+v", as)
+	}
+
+	// a newer observation of the same address wins
+	later := []ExitListEntry{{
+		Fingerprint:   "C1032C7046EF1D28E5D6D3EE402C21B0036EC52F",
+		ExitAddresses: []ExitAddress{{"91.121.43.81", time.Date(2019, 1, 1, 12, 8, 48, 0, time.UTC)}},
+	}}
+	m = MergeExitAddresses(m, later)
+	if as := m["C1032C7046EF1D28E5D6D3EE402C21B0036EC52F"]; len(as) != 1 || as[0].Time.Hour() != 12 {
+		t.Errorf("Unexpected addresses %+v", as)
+	}
+}
+
+func TestExitsLoadExitList(t *testing.T) {
+	c := loadConsensus(t, "testdata/consensuses/2019-01-01-12-00-00-consensus")
+	e := &Exits{now: func() time.Time { return c.ValidAfter }}
+	e.Update(c.Policies(c.ValidAfter), false)
+
+	e.assertIsTor(t, "91.121.43.81", false)
+
+	file, err := os.Open("testdata/exit-lists/2019-01-01-12-02-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err = e.LoadExitList(file); err != nil {
+		t.Fatal(err)
+	}
+
+	// measured addresses are added alongside the published ones
+	e.assertIsTor(t, "91.121.43.81", true)
+	e.assertIsTor(t, "91.121.43.80", true)
+	e.assertIsTor(t, "51.15.43.207", true)
+	if fingerprint, _ := e.IsTor("91.121.43.81"); fingerprint != "C1032C7046EF1D28E5D6D3EE402C21B0036EC52F" {
+		t.Errorf("Got fingerprint %s", fingerprint)
+	}
+
+	// but not for relays that aren't exits
+	e.assertIsTor(t, "51.15.43.206", false)
+	e.assertIsTor(t, "198.51.100.7", false)
+
+	// and survive reloading the policies
+	e.Update(c.Policies(c.ValidAfter), true)
+	e.assertIsTor(t, "91.121.43.81", true)
+	expectDump(t, e, "38.229.70.31", 8080, "91.121.43.80", "91.121.43.81", "83.227.52.198")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/samuel/go-gettext/gettext"
 	"html/template"
@@ -10,6 +11,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"time"
@@ -26,6 +28,16 @@ type Page struct {
 	Lang        string
 	IP          string
 	Locales     map[string]string
+	Stale       bool
+}
+
+// set on api responses answered from stale data
+const StaleHeader = "X-Exit-List-Stale"
+
+func setStale(w http.ResponseWriter, stale bool) {
+	if stale {
+		w.Header().Set(StaleHeader, "1")
+	}
 }
 
 func RootHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain, Phttp *http.ServeMux, Locales map[string]string) http.HandlerFunc {
@@ -46,13 +58,16 @@ func RootHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain
 			fingerprint string
 		)
 
+		data := Exits.Current()
+		stale := data.IsStale(Exits.MaxAge, Exits.clock())
+
 		if host, err = GetHost(r); err == nil {
-			fingerprint, isTor = Exits.IsTor(host)
+			fingerprint, isTor = data.IsTor(host)
 		}
 
 		// short circuit for torbutton
 		if IsParamSet(r, "TorButton") {
-			WriteHTMLBuf(w, r, Layout, domain, "torbutton.html", Page{IsTor: isTor})
+			WriteHTMLBuf(w, r, Layout, domain, "torbutton.html", Page{IsTor: isTor, Stale: stale})
 			return
 		}
 
@@ -87,6 +102,7 @@ func RootHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain
 			Lang(r),
 			host,
 			Locales,
+			stale,
 		}
 
 		// render the template
@@ -98,24 +114,173 @@ func RootHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain
 type IPResp struct {
 	IsTor bool
 	IP    string
+	Stale bool `json:",omitempty"`
+	// only when asked about an addr
+	Fingerprints []string `json:",omitempty"`
+	Target       string   `json:",omitempty"`
+	// only when asked about the past
+	At string `json:",omitempty"`
+}
+
+type APIError struct {
+	Error string
+}
+
+func writeAPIError(w http.ResponseWriter, msg string) {
+	w.WriteHeader(http.StatusBadRequest)
+	b, _ := json.Marshal(APIError{msg})
+	w.Write(b)
+}
+
+// the target to check addr against. the default target of addr's
+// family, with the address or port replaced if they're given
+func apiTarget(q url.Values, ip net.IP) (AddressPort, error) {
+	target := DefaultTarget
+	if isIPv6(ip) {
+		target = DefaultTarget6
+	}
+	if t := q.Get("target"); len(t) > 0 {
+		tip := ParseAddress(t)
+		if tip == nil {
+			return target, fmt.Errorf("invalid target %q", t)
+		}
+		target.Address = tip.String()
+	}
+	if p := q.Get("port"); len(p) > 0 {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return target, fmt.Errorf("invalid port %q", p)
+		}
+		target.Port = port
+	}
+	return target, nil
+}
+
+// whether addr, or the caller, was an exit at the time, from the history
+func historyResp(Exits *Exits, r *http.Request, q url.Values) (resp IPResp, err error) {
+	at := q.Get("at")
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return resp, fmt.Errorf("invalid at %q, expected a time like 2006-01-02T15:04:05Z", at)
+	}
+	if Exits.History == nil {
+		return resp, errors.New("no history is kept")
+	}
+	if len(q.Get("target")) > 0 || len(q.Get("port")) > 0 {
+		return resp, errors.New("the history doesn't know about targets or ports")
+	}
+	addr := q.Get("addr")
+	if len(addr) == 0 {
+		if addr, err = GetHost(r); err != nil {
+			return resp, err
+		}
+	}
+	ip := ParseAddress(addr)
+	if ip == nil {
+		return resp, fmt.Errorf("invalid addr %q", addr)
+	}
+	fingerprints := Exits.History.At(ip.String(), t)
+	return IPResp{
+		IsTor:        len(fingerprints) > 0,
+		IP:           ip.String(),
+		Fingerprints: fingerprints,
+		At:           t.UTC().Format(time.RFC3339),
+	}, nil
 }
 
+// answers about the caller, or with ?addr= about any address, optionally
+// against another target= and port=, or with ?at= in the past
 func APIHandler(Exits *Exits) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
+		data := Exits.Current()
+		stale := data.IsStale(Exits.MaxAge, Exits.clock())
+		setStale(w, stale)
+
+		q := r.URL.Query()
+		if len(q.Get("at")) > 0 {
+			resp, err := historyResp(Exits, r, q)
+			if err != nil {
+				writeAPIError(w, err.Error())
+				return
+			}
+			b, _ := json.Marshal(resp)
+			w.Write(b)
+			return
+		}
+		if addr := q.Get("addr"); len(addr) > 0 {
+			ip := ParseAddress(addr)
+			if ip == nil {
+				writeAPIError(w, fmt.Sprintf("invalid addr %q", addr))
+				return
+			}
+			target, err := apiTarget(q, ip)
+			if err != nil {
+				writeAPIError(w, err.Error())
+				return
+			}
+			fingerprints := data.ExitsTo(ip.String(), target)
+			resp := IPResp{
+				IsTor:        len(fingerprints) > 0,
+				IP:           ip.String(),
+				Stale:        stale,
+				Fingerprints: fingerprints,
+				Target:       joinAddressPort(target),
+			}
+			b, _ := json.Marshal(resp)
+			w.Write(b)
+			return
+		}
+
 		var (
 			err   error
 			isTor bool
 			host  string
 		)
 		if host, err = GetHost(r); err == nil {
-			_, isTor = Exits.IsTor(host)
+			_, isTor = data.IsTor(host)
 		}
-		ip, _ := json.Marshal(IPResp{isTor, host})
+		ip, _ := json.Marshal(IPResp{IsTor: isTor, IP: host, Stale: stale})
 		w.Write(ip)
 	}
 }
 
+type HealthResp struct {
+	Healthy    bool
+	Generation uint64
+	UpdateTime time.Time
+	DataTime   time.Time
+	Age        string
+	MaxAge     string
+}
+
+// 503 once the data is stale so monitoring notices a broken cron job
+func HealthHandler(Exits *Exits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := Exits.Current()
+		now := Exits.clock()
+		resp := HealthResp{
+			Healthy:    !data.IsStale(Exits.MaxAge, now),
+			Generation: data.Generation,
+			UpdateTime: data.UpdateTime,
+			DataTime:   data.DataTime,
+			MaxAge:     Exits.MaxAge.String(),
+		}
+		if data.Generation > 0 {
+			resp.Age = now.Sub(data.DataTime).Round(time.Second).String()
+		}
+		b, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if resp.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(b)
+	}
+}
+
 func BulkHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain) http.HandlerFunc {
 
 	ApiPath := regexp.MustCompile("^/api/")
@@ -124,25 +289,33 @@ func BulkHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain
 		q := r.URL.Query()
 
 		ip := q.Get("ip")
-		if net.ParseIP(ip) == nil {
+		if ParseAddress(ip) == nil {
 			WriteHTMLBuf(w, r, Layout, domain, "bulk.html", Page{Lang: "en"})
 			return
 		}
 
 		port, port_str := GetQS(q, "port", 80)
-		n, n_str := GetQS(q, "n", 16)
+		n, n_str := GetQS(q, "n", DefaultTminus)
+
+		// one generation of the data for the whole response
+		data := Exits.Current()
 
-		w.Header().Set("Last-Modified", Exits.UpdateTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("Last-Modified", data.UpdateTime.UTC().Format(http.TimeFormat))
+		stale := data.IsStale(Exits.MaxAge, Exits.clock())
+		setStale(w, stale)
 
 		if q.Get("format") == "json" || ApiPath.MatchString(r.URL.Path) {
 			w.Header().Set("Content-Type", "application/json")
-			Exits.DumpJSON(w, n, ip, port)
+			data.DumpJSON(w, n, ip, port)
 		} else {
 			str := fmt.Sprintf("# This is a list of all Tor exit nodes from the past %d hours that can contact %s on port %d #\n", n, ip, port)
 			str += fmt.Sprintf("# You can update this list by visiting https://check.torproject.org/cgi-bin/TorBulkExitList.py?ip=%s%s%s #\n", ip, port_str, n_str)
-			str += fmt.Sprintf("# This file was generated on %v #\n", Exits.UpdateTime.UTC().Format(time.UnixDate))
+			str += fmt.Sprintf("# This file was generated on %v #\n", data.UpdateTime.UTC().Format(time.UnixDate))
+			if stale {
+				str += "# Warning: this list is out of date, the exit data hasn't been updated recently #\n"
+			}
 			fmt.Fprintf(w, str)
-			Exits.Dump(w, n, ip, port)
+			data.Dump(w, n, ip, port)
 		}
 
 	}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const handlersTestData = `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1"}`
+
+func serve(h http.Handler, target string, remoteAddr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestIsStale(t *testing.T) {
+	now := time.Now()
+	d := &ExitData{Generation: 1, UpdateTime: now, DataTime: now.Add(-2 * time.Hour)}
+	if d.IsStale(3*time.Hour, now) {
+		t.Error("Expected fresh data")
+	}
+	if !d.IsStale(time.Hour, now) {
+		t.Error("Expected stale data")
+	}
+	if d.IsStale(0, now) {
+		t.Error("A zero max age should never be stale")
+	}
+	if !new(ExitData).IsStale(0, now) {
+		t.Error("Nothing loaded should be stale")
+	}
+}
+
+func TestAPIHandlerStale(t *testing.T) {
+	exits := setupExitList(t, handlersTestData)
+	exits.MaxAge = time.Hour
+	h := APIHandler(exits)
+
+	w := serve(h, "/api/ip", "111.111.111.111:1234")
+	if w.Header().Get(StaleHeader) != "" {
+		t.Error("Fresh data flagged as stale")
+	}
+	if body := w.Body.String(); body != `{"IsTor":true,"IP":"111.111.111.111"}` {
+		t.Errorf("Got %s", body)
+	}
+
+	exits.MaxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	w = serve(h, "/api/ip", "111.111.111.111:1234")
+	if w.Header().Get(StaleHeader) != "1" {
+		t.Error("Expected the stale header")
+	}
+	var resp IPResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsTor || !resp.Stale {
+		t.Errorf("Got %+v", resp)
+	}
+}
+
+func TestBulkHandlerStale(t *testing.T) {
+	exits := setupExitList(t, handlersTestData)
+	exits.MaxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	h := BulkHandler(nil, exits, nil)
+
+	w := serve(h, "/api/bulk?ip=38.229.70.31&port=443", "127.0.0.1:1234")
+	if w.Header().Get(StaleHeader) != "1" {
+		t.Error("Expected the stale header")
+	}
+	if !strings.Contains(w.Body.String(), "111.111.111.111") {
+		t.Errorf("Got %s", w.Body.String())
+	}
+
+	w = serve(h, "/torbulkexitlist?ip=38.229.70.31&port=443", "127.0.0.1:1234")
+	if !strings.Contains(w.Body.String(), "# Warning: this list is out of date") {
+		t.Errorf("Expected a warning in %s", w.Body.String())
+	}
+
+	exits.MaxAge = 0
+	w = serve(h, "/torbulkexitlist?ip=38.229.70.31&port=443", "127.0.0.1:1234")
+	if w.Header().Get(StaleHeader) != "" || strings.Contains(w.Body.String(), "Warning") {
+		t.Error("Fresh data flagged as stale")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	exits := new(Exits)
+	h := HealthHandler(exits)
+
+	// nothing loaded yet
+	if w := serve(h, "/health", "127.0.0.1:1234"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got %d before loading", w.Code)
+	}
+
+	exits = setupExitList(t, handlersTestData)
+	exits.MaxAge = time.Hour
+	h = HealthHandler(exits)
+	w := serve(h, "/health", "127.0.0.1:1234")
+	var resp HealthResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || !resp.Healthy || resp.Generation != 1 || resp.MaxAge != "1h0m0s" {
+		t.Errorf("Got %d, %+v", w.Code, resp)
+	}
+
+	exits.MaxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if w = serve(h, "/health", "127.0.0.1:1234"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got %d with stale data", w.Code)
+	}
+}
+
+func TestBulkHandlerIPv6(t *testing.T) {
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": "::", "Mask": "::"}, {"IsAccept": false, "MinPort": 1, "MaxPort": 65535, "Address": "::", "Mask": "::"}, {"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111", "2001:db8::1"], "Fingerprint": "1"}`
+	exits := setupExitList(t, testData)
+	h := BulkHandler(nil, exits, nil)
+
+	w := serve(h, "/torbulkexitlist?ip=2001:0db8:4::1&port=443", "127.0.0.1:1234")
+	if body := w.Body.String(); !strings.HasSuffix(body, " #\n2001:db8::1\n") {
+		t.Errorf("Got %s", body)
+	}
+	w = serve(h, "/api/bulk?ip=38.229.70.31&port=443", "127.0.0.1:1234")
+	if body := w.Body.String(); !strings.Contains(body, `"111.111.111.111"`) || strings.Contains(body, "2001:db8::1") {
+		t.Errorf("Got %s", body)
+	}
+
+	w = serve(APIHandler(exits), "/api/ip", "[2001:db8::1]:1234")
+	if body := w.Body.String(); body != `{"IsTor":true,"IP":"2001:db8::1"}` {
+		t.Errorf("Got %s", body)
+	}
+}
+
+func TestAPIHandlerAddr(t *testing.T) {
+	testData := handlersTestData + "\n" + `{"Rules": [{"IsAccept": true, "MinPort": 80, "MaxPort": 80, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "2"}
+		{"Rules": [{"IsAccept": false, "MinPort": 1, "MaxPort": 65535, "Address": "38.229.72.22", "Mask": "255.255.255.255"}, {"IsAccept": true, "MinPort": 1, "MaxPort": 65535, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["222.222.222.222"], "Fingerprint": "3"}`
+	exits := setupExitList(t, testData)
+	h := APIHandler(exits)
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"addr=111.111.111.111", `{"IsTor":true,"IP":"111.111.111.111","Fingerprints":["1"],"Target":"38.229.72.22:443"}`},
+		{"addr=111.111.111.111&port=80", `{"IsTor":true,"IP":"111.111.111.111","Fingerprints":["2"],"Target":"38.229.72.22:80"}`},
+		{"addr=111.111.111.111&port=22", `{"IsTor":false,"IP":"111.111.111.111","Target":"38.229.72.22:22"}`},
+		{"addr=111.111.111.111&port=80&target=8.8.8.8", `{"IsTor":true,"IP":"111.111.111.111","Fingerprints":["2"],"Target":"8.8.8.8:80"}`},
+		{"addr=222.222.222.222", `{"IsTor":false,"IP":"222.222.222.222","Target":"38.229.72.22:443"}`},
+		{"addr=222.222.222.222&target=8.8.8.8", `{"IsTor":true,"IP":"222.222.222.222","Fingerprints":["3"],"Target":"8.8.8.8:443"}`},
+		{"addr=::ffff:111.111.111.111", `{"IsTor":true,"IP":"111.111.111.111","Fingerprints":["1"],"Target":"38.229.72.22:443"}`},
+		{"addr=1.2.3.4", `{"IsTor":false,"IP":"1.2.3.4","Target":"38.229.72.22:443"}`},
+		{"addr=2001:db8::1", `{"IsTor":false,"IP":"2001:db8::1","Target":"[` + DefaultTarget6.Address + `]:443"}`},
+	}
+	for _, x := range tests {
+		// asked from an exit, the answer is still about addr
+		w := serve(h, "/api/ip?"+x.query, "111.111.111.111:1234")
+		if w.Code != http.StatusOK || w.Body.String() != x.expected {
+			t.Errorf("Got %d %s for %s, expected %s", w.Code, w.Body.String(), x.query, x.expected)
+		}
+	}
+
+	for _, query := range []string{"addr=example.com", "addr=1.2.3.4&port=0", "addr=1.2.3.4&port=http", "addr=1.2.3.4&target=nowhere"} {
+		w := serve(h, "/api/ip?"+query, "127.0.0.1:1234")
+		var resp APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusBadRequest || len(resp.Error) == 0 {
+			t.Errorf("Got %d %s for %s, expected an error", w.Code, w.Body.String(), query)
+		}
+	}
+
+	// without addr, the caller as before
+	w := serve(h, "/api/ip?port=80", "111.111.111.111:1234")
+	if body := w.Body.String(); body != `{"IsTor":true,"IP":"111.111.111.111"}` {
+		t.Errorf("Got %s", body)
+	}
+}
+
+func TestAPIHandlerAt(t *testing.T) {
+	exits := setupExitList(t, handlersTestData)
+	h := APIHandler(exits)
+
+	if w := serve(h, "/api/ip?addr=111.111.111.111&at=2026-01-01T00:00:00Z", "127.0.0.1:1234"); w.Code != http.StatusBadRequest {
+		t.Errorf("Got %d without a history", w.Code)
+	}
+
+	exits.History = &History{intervals: make(map[string]map[string][]Interval)}
+	exits.History.Record(historyGeneration(0, 0, "1@111.111.111.111"))
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"addr=111.111.111.111&at=2026-01-01T00:30:00Z", `{"IsTor":true,"IP":"111.111.111.111","Fingerprints":["1"],"At":"2026-01-01T00:30:00Z"}`},
+		{"addr=111.111.111.111&at=2026-01-01T02:30:00%2B02:00", `{"IsTor":true,"IP":"111.111.111.111","Fingerprints":["1"],"At":"2026-01-01T00:30:00Z"}`},
+		{"addr=111.111.111.111&at=2025-12-31T23:00:00Z", `{"IsTor":false,"IP":"111.111.111.111","At":"2025-12-31T23:00:00Z"}`},
+		{"addr=1.2.3.4&at=2026-01-01T00:30:00Z", `{"IsTor":false,"IP":"1.2.3.4","At":"2026-01-01T00:30:00Z"}`},
+	}
+	for _, x := range tests {
+		w := serve(h, "/api/ip?"+x.query, "127.0.0.1:1234")
+		if w.Code != http.StatusOK || w.Body.String() != x.expected {
+			t.Errorf("Got %d %s for %s, expected %s", w.Code, w.Body.String(), x.query, x.expected)
+		}
+	}
+
+	// the caller
+	w := serve(h, "/api/ip?at=2026-01-01T00:30:00Z", "111.111.111.111:1234")
+	if body := w.Body.String(); body != `{"IsTor":true,"IP":"111.111.111.111","Fingerprints":["1"],"At":"2026-01-01T00:30:00Z"}` {
+		t.Errorf("Got %s", body)
+	}
+
+	for _, query := range []string{"addr=1.2.3.4&at=yesterday", "addr=1.2.3.4&at=2026-01-01", "addr=nonsense&at=2026-01-01T00:00:00Z", "addr=1.2.3.4&port=80&at=2026-01-01T00:00:00Z"} {
+		if w := serve(h, "/api/ip?"+query, "127.0.0.1:1234"); w.Code != http.StatusBadRequest {
+			t.Errorf("Got %d %s for %s, expected an error", w.Code, w.Body.String(), query)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// observations of an exit at an address further apart than this start
+// a new interval
+const HistoryMaxGap = 3 * time.Hour
+
+// an exit counts for a while after it was last seen, for as long as the
+// consensus it was last seen in was fresh
+const HistorySlack = time.Hour
+
+// how long sightings are kept by default
+const DefaultHistoryRetention = 90 * 24 * time.Hour
+
+// when an exit was seen at an address
+type Interval struct {
+	First time.Time
+	Last  time.Time
+}
+
+// a line of the history file
+type HistoryRecord struct {
+	Address     string
+	Fingerprint string
+	First       time.Time
+	Last        time.Time
+}
+
+// when each exit was seen at each address, built up from every
+// generation of the exit data and kept in a file across restarts so we
+// can answer about the past, long after the consensuses are gone
+type History struct {
+	Path string
+	// sightings older than this are dropped as new ones are recorded, 0
+	// keeps everything
+	Retention time.Duration
+	mu        sync.RWMutex
+	// one Save at a time, without holding up Record
+	saveMu sync.Mutex
+	// address -> fingerprint -> intervals, sorted and apart
+	intervals map[string]map[string][]Interval
+}
+
+// reads the history at path, which doesn't need to exist yet
+func LoadHistory(path string) (*History, error) {
+	h := &History{Path: path, intervals: make(map[string]map[string][]Interval)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = h.read(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return h, nil
+}
+
+func (h *History) read(source io.Reader) error {
+	dec := json.NewDecoder(source)
+	for n := 1; ; n++ {
+		var r HistoryRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("record %d: %v", n, err)
+		}
+		if ParseAddress(r.Address) == nil || len(r.Fingerprint) == 0 || r.Last.Before(r.First) {
+			return fmt.Errorf("record %d: invalid %+v", n, r)
+		}
+		h.observe(CanonicalIP(r.Address), r.Fingerprint, Interval{r.First, r.Last})
+	}
+}
+
+// adds the interval, merging it with the ones it touches
+func (h *History) observe(address string, fingerprint string, iv Interval) {
+	fps, ok := h.intervals[address]
+	if !ok {
+		fps = make(map[string][]Interval)
+		h.intervals[address] = fps
+	}
+	ivs := append(fps[fingerprint], iv)
+	sort.Slice(ivs, func(i, j int) bool { return ivs[i].First.Before(ivs[j].First) })
+	merged := ivs[:1]
+	for _, x := range ivs[1:] {
+		last := &merged[len(merged)-1]
+		if x.First.Sub(last.Last) <= HistoryMaxGap {
+			if x.Last.After(last.Last) {
+				last.Last = x.Last
+			}
+		} else {
+			merged = append(merged, x)
+		}
+	}
+	fps[fingerprint] = merged
+}
+
+// adds the exits in a generation, each address as of when the exit was
+// last seen there, and drops what's past Retention
+func (h *History) Record(d *ExitData) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, pa := range d.List {
+		seen := pa.LastSeen
+		if seen.IsZero() {
+			seen = d.UpdateTime.Add(-time.Duration(pa.Tminus) * time.Hour)
+		}
+		seen = seen.Truncate(time.Second)
+		h.observe(CanonicalIP(pa.Address), pa.Policy.Fingerprint, Interval{seen, seen})
+	}
+	if h.Retention > 0 {
+		h.prune(d.UpdateTime.Add(-h.Retention))
+	}
+}
+
+// drops the intervals that ended before cutoff
+func (h *History) prune(cutoff time.Time) {
+	for addr, fps := range h.intervals {
+		for fp, ivs := range fps {
+			var kept []Interval
+			for _, iv := range ivs {
+				if !iv.Last.Before(cutoff) {
+					kept = append(kept, iv)
+				}
+			}
+			if len(kept) == 0 {
+				delete(fps, fp)
+			} else {
+				fps[fp] = kept
+			}
+		}
+		if len(fps) == 0 {
+			delete(h.intervals, addr)
+		}
+	}
+}
+
+// the fingerprints of the exits at addr at time t
+func (h *History) At(addr string, t time.Time) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var fingerprints []string
+	for fp, ivs := range h.intervals[CanonicalIP(addr)] {
+		for _, iv := range ivs {
+			if !t.Before(iv.First) && !t.After(iv.Last.Add(HistorySlack)) {
+				fingerprints = append(fingerprints, fp)
+				break
+			}
+		}
+	}
+	sort.Strings(fingerprints)
+	return fingerprints
+}
+
+// when the exit was seen at addr
+func (h *History) Intervals(addr string, fingerprint string) []Interval {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]Interval(nil), h.intervals[CanonicalIP(addr)][fingerprint]...)
+}
+
+func (h *History) Len() (n int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, fps := range h.intervals {
+		for _, ivs := range fps {
+			n += len(ivs)
+		}
+	}
+	return
+}
+
+func (h *History) records() []HistoryRecord {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var records []HistoryRecord
+	for addr, fps := range h.intervals {
+		for fp, ivs := range fps {
+			for _, iv := range ivs {
+				records = append(records, HistoryRecord{addr, fp, iv.First.UTC(), iv.Last.UTC()})
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Address != b.Address {
+			return a.Address < b.Address
+		}
+		if a.Fingerprint != b.Fingerprint {
+			return a.Fingerprint < b.Fingerprint
+		}
+		return a.First.Before(b.First)
+	})
+	return records
+}
+
+// one record per line, sorted so the file diffs well
+func (h *History) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, r := range h.records() {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes the history to Path, replacing it atomically. Record can carry
+// on meanwhile
+func (h *History) Save() error {
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+	return writeFileAtomic(h.Path, h.write)
+}
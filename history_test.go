@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var historyStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func hoursAfter(h int) time.Time {
+	return historyStart.Add(time.Duration(h) * time.Hour)
+}
+
+// a generation loaded at hour, with the exits at the addresses seen
+// tminus hours before
+func historyGeneration(hour int, tminus int, exits ...string) *ExitData {
+	d := &ExitData{UpdateTime: hoursAfter(hour)}
+	for _, e := range exits {
+		parts := strings.SplitN(e, "@", 2)
+		d.List = append(d.List, PolicyAddress{Policy: Policy{Fingerprint: parts[0], Tminus: tminus}, Address: parts[1], Tminus: tminus})
+	}
+	return d
+}
+
+func TestHistoryIntervals(t *testing.T) {
+	h, err := LoadHistory(path.Join(os.TempDir(), "check-missing-history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hourly, then a gap, then out of order
+	for _, hour := range []int{0, 1, 2, 3, 10, 11, 7} {
+		h.Record(historyGeneration(hour, 0, "A@1.1.1.1"))
+	}
+	expected := []Interval{{hoursAfter(0), hoursAfter(3)}, {hoursAfter(7), hoursAfter(11)}}
+	if ivs := h.Intervals("1.1.1.1", "A"); !reflect.DeepEqual(ivs, expected) {
+		t.Errorf("Got %v, expected %v", ivs, expected)
+	}
+
+	// seen tminus hours before the load
+	h.Record(historyGeneration(30, 5, "A@1.1.1.1", "B@2001:0db8::1"))
+	expected = append(expected, Interval{hoursAfter(25), hoursAfter(25)})
+	if ivs := h.Intervals("1.1.1.1", "A"); !reflect.DeepEqual(ivs, expected) {
+		t.Errorf("Got %v, expected %v", ivs, expected)
+	}
+	if n := h.Len(); n != 4 {
+		t.Errorf("Got %d intervals, expected 4", n)
+	}
+
+	tests := []struct {
+		addr     string
+		at       time.Time
+		expected []string
+	}{
+		{"1.1.1.1", hoursAfter(-1), nil},
+		{"1.1.1.1", hoursAfter(0), []string{"A"}},
+		{"1.1.1.1", hoursAfter(2).Add(30 * time.Minute), []string{"A"}},
+		// still in a fresh consensus
+		{"1.1.1.1", hoursAfter(4), []string{"A"}},
+		{"1.1.1.1", hoursAfter(4).Add(time.Second), nil},
+		{"1.1.1.1", hoursAfter(8), []string{"A"}},
+		{"1.1.1.1", hoursAfter(20), nil},
+		{"1.1.1.1", hoursAfter(25), []string{"A"}},
+		{"2001:db8::1", hoursAfter(25), []string{"B"}},
+		{"[2001:db8:0::1]", hoursAfter(25), []string{"B"}},
+		{"1.1.1.2", hoursAfter(0), nil},
+	}
+	for _, x := range tests {
+		if fps := h.At(x.addr, x.at); !reflect.DeepEqual(fps, x.expected) {
+			t.Errorf("Got %v for %s at %v, expected %v", fps, x.addr, x.at, x.expected)
+		}
+	}
+}
+
+func TestHistorySharedAddress(t *testing.T) {
+	h, _ := LoadHistory(path.Join(os.TempDir(), "check-missing-history"))
+	h.Record(historyGeneration(0, 0, "A@1.1.1.1", "B@1.1.1.1"))
+	h.Record(historyGeneration(1, 0, "B@1.1.1.1"))
+	h.Record(historyGeneration(5, 0, "B@1.1.1.1"))
+	if fps := h.At("1.1.1.1", hoursAfter(0)); !reflect.DeepEqual(fps, []string{"A", "B"}) {
+		t.Errorf("Got %v", fps)
+	}
+	if fps := h.At("1.1.1.1", hoursAfter(5)); !reflect.DeepEqual(fps, []string{"B"}) {
+		t.Errorf("Got %v", fps)
+	}
+}
+
+func TestHistorySave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyPath := path.Join(dir, "history")
+
+	h, err := LoadHistory(historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Record(historyGeneration(0, 0, "B@2.2.2.2", "A@1.1.1.1"))
+	h.Record(historyGeneration(10, 0, "A@1.1.1.1"))
+	if err = h.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`{"Address":"1.1.1.1","Fingerprint":"A","First":"%[1]s","Last":"%[1]s"}
+{"Address":"1.1.1.1","Fingerprint":"A","First":"%[2]s","Last":"%[2]s"}
+{"Address":"2.2.2.2","Fingerprint":"B","First":"%[1]s","Last":"%[1]s"}
+`, "2026-01-01T00:00:00Z", "2026-01-01T10:00:00Z")
+	if string(b) != expected {
+		t.Errorf("Got %s, expected %s", b, expected)
+	}
+
+	// the same after a restart
+	read, err := LoadHistory(historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = read.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Got %s after loading, expected %s", buf.String(), expected)
+	}
+
+	if err = ioutil.WriteFile(historyPath, []byte(`{"Address":"nonsense","Fingerprint":"A"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadHistory(historyPath); err == nil {
+		t.Error("Expected an invalid history to fail")
+	}
+}
+
+func TestExitsHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyPath := path.Join(dir, "history")
+
+	exits := new(Exits)
+	if exits.History, err = LoadHistory(historyPath); err != nil {
+		t.Fatal(err)
+	}
+	if err = exits.Load(strings.NewReader(handlersTestData), false); err != nil {
+		t.Fatal(err)
+	}
+	loaded := exits.Current().UpdateTime
+
+	// replaced by another exit, but still in the history
+	other := strings.Replace(strings.Replace(handlersTestData, "111.111.111.111", "222.222.222.222", 1), `"1"`, `"2"`, 1)
+	if err = exits.Load(strings.NewReader(other), false); err != nil {
+		t.Fatal(err)
+	}
+	exits.assertIsTor(t, "111.111.111.111", false)
+
+	h, err := LoadHistory(historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fps := h.At("111.111.111.111", loaded); !reflect.DeepEqual(fps, []string{"1"}) {
+		t.Errorf("Got %v after a restart", fps)
+	}
+	if fps := h.At("222.222.222.222", time.Now()); !reflect.DeepEqual(fps, []string{"2"}) {
+		t.Errorf("Got %v after a restart", fps)
+	}
+}
+
+func TestExitsHistoryAddressMoves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, err := LoadHistory(path.Join(dir, "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := historyStart.Add(10 * time.Minute)
+	e := &Exits{now: func() time.Time { return now }, History: h}
+	e.Update([]Policy{agingPolicy("A", "1.1.1.1", historyStart)}, false)
+	for hour := 1; hour <= 48; hour++ {
+		now = hoursAfter(hour).Add(10 * time.Minute)
+		e.Update([]Policy{agingPolicy("A", "2.2.2.2", hoursAfter(hour))}, true)
+	}
+
+	// the old address is only recorded for when A was last seen there,
+	// though the merged list kept it for hours
+	expected := []Interval{{hoursAfter(0), hoursAfter(0)}}
+	if ivs := h.Intervals("1.1.1.1", "A"); !reflect.DeepEqual(ivs, expected) {
+		t.Errorf("Got %v, expected %v", ivs, expected)
+	}
+	if fps := h.At("1.1.1.1", hoursAfter(40)); len(fps) > 0 {
+		t.Errorf("Got %v for the address A moved from", fps)
+	}
+	if fps := h.At("1.1.1.1", hoursAfter(0)); !reflect.DeepEqual(fps, []string{"A"}) {
+		t.Errorf("Got %v before A moved", fps)
+	}
+	if fps := h.At("2.2.2.2", hoursAfter(40)); !reflect.DeepEqual(fps, []string{"A"}) {
+		t.Errorf("Got %v for the address A moved to", fps)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	h, err := LoadHistory(path.Join(os.TempDir(), "check-missing-history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Retention = 24 * time.Hour
+
+	h.Record(historyGeneration(0, 0, "A@1.1.1.1", "B@2.2.2.2"))
+	h.Record(historyGeneration(20, 0, "B@2.2.2.2"))
+	h.Record(historyGeneration(30, 0, "B@2.2.2.2"))
+
+	if ivs := h.Intervals("1.1.1.1", "A"); len(ivs) > 0 {
+		t.Errorf("Got %v past the retention", ivs)
+	}
+	expected := []Interval{{hoursAfter(20), hoursAfter(20)}, {hoursAfter(30), hoursAfter(30)}}
+	if ivs := h.Intervals("2.2.2.2", "B"); !reflect.DeepEqual(ivs, expected) {
+		t.Errorf("Got %v, expected %v", ivs, expected)
+	}
+	if n := h.Len(); n != 2 {
+		t.Errorf("Got %d intervals, expected 2", n)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+)
+
+// a binary radix tree over the bits of an address. ipv4 addresses are
+// keyed by their 4 byte form, in their own tree, so 1.2.3.4 and
+// ::ffff:1.2.3.4 are the same key. safe for concurrent lookups once
+// it's no longer being modified
+type IPTree struct {
+	root4 *ipNode
+	root6 *ipNode
+	size  int
+}
+
+type ipNode struct {
+	child [2]*ipNode
+	value interface{}
+	set   bool
+}
+
+// the key bytes and the root for the address's family
+func (t *IPTree) family(ip net.IP, create bool) ([]byte, **ipNode) {
+	if ip4 := ip.To4(); ip4 != nil {
+		if t.root4 == nil && create {
+			t.root4 = new(ipNode)
+		}
+		return ip4, &t.root4
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		if t.root6 == nil && create {
+			t.root6 = new(ipNode)
+		}
+		return ip16, &t.root6
+	}
+	return nil, nil
+}
+
+func bitAt(key []byte, i int) int {
+	return int(key[i/8]>>(7-uint(i%8))) & 1
+}
+
+// sets the value for the first bits of ip, replacing any previous value
+func (t *IPTree) Insert(ip net.IP, bits int, value interface{}) bool {
+	key, root := t.family(ip, true)
+	if key == nil || bits < 0 || bits > len(key)*8 {
+		return false
+	}
+	n := *root
+	for i := 0; i < bits; i++ {
+		b := bitAt(key, i)
+		if n.child[b] == nil {
+			n.child[b] = new(ipNode)
+		}
+		n = n.child[b]
+	}
+	if !n.set {
+		t.size += 1
+	}
+	n.value, n.set = value, true
+	return true
+}
+
+func (t *IPTree) InsertNet(ipNet *net.IPNet, value interface{}) bool {
+	ones, bits := ipNet.Mask.Size()
+	if bits == 0 {
+		return false
+	}
+	// a v4 network in 16 byte form
+	if len(ipNet.IP.To4()) == net.IPv4len && bits == 8*net.IPv6len {
+		ones -= 96
+	}
+	return t.Insert(ipNet.IP, ones, value)
+}
+
+// the value of the longest prefix containing ip
+func (t *IPTree) Lookup(ip net.IP) (value interface{}, ok bool) {
+	key, root := t.family(ip, false)
+	if key == nil {
+		return nil, false
+	}
+	n := *root
+	for i := 0; n != nil; i++ {
+		if n.set {
+			value, ok = n.value, true
+		}
+		if i == len(key)*8 {
+			break
+		}
+		n = n.child[bitAt(key, i)]
+	}
+	return
+}
+
+func (t *IPTree) Contains(ip net.IP) bool {
+	_, ok := t.Lookup(ip)
+	return ok
+}
+
+func (t *IPTree) Len() int {
+	return t.size
+}
+
+// calls fn for every prefix in the tree, ipv4 first and in address order
+func (t *IPTree) Walk(fn func(ip net.IP, bits int, value interface{})) {
+	walkNode(t.root4, make([]byte, net.IPv4len), 0, fn)
+	walkNode(t.root6, make([]byte, net.IPv6len), 0, fn)
+}
+
+func walkNode(n *ipNode, key []byte, depth int, fn func(net.IP, int, interface{})) {
+	if n == nil {
+		return
+	}
+	if n.set {
+		ip := make(net.IP, len(key))
+		copy(ip, key)
+		fn(ip, depth, n.value)
+	}
+	for b, c := range n.child {
+		if c == nil {
+			continue
+		}
+		mask := byte(1) << (7 - uint(depth%8))
+		if b == 1 {
+			key[depth/8] |= mask
+		}
+		walkNode(c, key, depth+1, fn)
+		key[depth/8] &^= mask
+	}
+}
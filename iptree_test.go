@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPTree(t *testing.T) {
+	tree := new(IPTree)
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	_, inner, _ := net.ParseCIDR("10.1.0.0/16")
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	if !tree.InsertNet(private, "private") || !tree.InsertNet(inner, "inner") || !tree.InsertNet(v6, "v6") {
+		t.Fatal("Failed to insert networks")
+	}
+	if !tree.Insert(net.ParseIP("111.111.111.111"), 32, "host") {
+		t.Fatal("Failed to insert a host")
+	}
+	if tree.Insert(net.ParseIP("111.111.111.111"), 33, "too long") || tree.Insert(nil, 0, "nothing") {
+		t.Error("Inserted an invalid prefix")
+	}
+	if tree.Len() != 4 {
+		t.Errorf("Got %d entries, expected 4", tree.Len())
+	}
+
+	lookups := map[string]interface{}{
+		"10.2.3.4":                "private",
+		"10.1.3.4":                "inner",
+		"111.111.111.111":         "host",
+		"::ffff:111.111.111.111":  "host",
+		"2001:db8::1":             "v6",
+		"111.111.111.112":         nil,
+		"11.0.0.1":                nil,
+		"2001:db9::1":             nil,
+		"::ffff:10.0.0.1":         "private",
+		"not an address":          nil,
+		"::a01:203":               nil, // 10.1.2.3's bits, but ipv6
+		"2001:0db8:0000::0000:01": "v6",
+	}
+	for addr, expected := range lookups {
+		v, ok := tree.Lookup(net.ParseIP(addr))
+		if ok != (expected != nil) || v != expected {
+			t.Errorf("Got %v, %v looking up %s, expected %v", v, ok, addr, expected)
+		}
+	}
+
+	// replacing doesn't add an entry
+	tree.Insert(net.ParseIP("111.111.111.111"), 32, "replaced")
+	if v, _ := tree.Lookup(net.ParseIP("111.111.111.111")); v != "replaced" || tree.Len() != 4 {
+		t.Errorf("Got %v and %d entries", v, tree.Len())
+	}
+
+	var walked []string
+	tree.Walk(func(ip net.IP, bits int, value interface{}) {
+		walked = append(walked, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, 8*len(ip))}).String())
+	})
+	expected := []string{"10.0.0.0/8", "10.1.0.0/16", "111.111.111.111/32", "2001:db8::/32"}
+	if len(walked) != len(expected) {
+		t.Fatalf("Walked %v, expected %v", walked, expected)
+	}
+	for i := range expected {
+		if walked[i] != expected[i] {
+			t.Errorf("Walked %v, expected %v", walked, expected)
+			break
+		}
+	}
+}
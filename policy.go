@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parses a port or port range ("80", "1-1024", "*")
+func ParsePortRange(s string) (min int, max int, err error) {
+	if s == "*" {
+		return 1, 65535, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	if min, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	max = min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	if !ValidPort(min) || !ValidPort(max) || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return min, max, nil
+}
+
+// parses the "accept|reject portlist" summary used by the consensus
+// p line and the descriptor ipv6-policy line, returning the address
+// wildcard rules and the default for ports that aren't listed
+func ParsePolicySummary(s string) (rules []Rule, isAllowedDefault bool, err error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, false, fmt.Errorf("invalid policy summary %q", s)
+	}
+
+	var isAccept bool
+	switch fields[0] {
+	case "accept":
+		isAccept = true
+	case "reject":
+		isAccept = false
+	default:
+		return nil, false, fmt.Errorf("invalid policy summary %q", s)
+	}
+
+	for _, ports := range strings.Split(fields[1], ",") {
+		min, max, err := ParsePortRange(ports)
+		if err != nil {
+			return nil, false, err
+		}
+		rules = append(rules, Rule{
+			IsAccept:          isAccept,
+			IsAddressWildcard: true,
+			MinPort:           min,
+			MaxPort:           max,
+		})
+	}
+
+	return rules, !isAccept, nil
+}
+
+func IsPortWildcard(r Rule) bool {
+	return r.MinPort <= 1 && r.MaxPort == 65535
+}
+
+type portRange struct {
+	min int
+	max int
+}
+
+type portRanges []portRange
+
+func (p portRanges) Less(i, j int) bool {
+	return p[i].min < p[j].min
+}
+
+func (p portRanges) Len() int {
+	return len(p)
+}
+
+func (p portRanges) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+// adds a range, keeping the list sorted and merged
+func (p *portRanges) Add(min, max int) {
+	rs := append(*p, portRange{min, max})
+	sort.Sort(rs)
+	merged := rs[:1]
+	for _, r := range rs[1:] {
+		last := &merged[len(merged)-1]
+		if r.min <= last.max+1 {
+			if r.max > last.max {
+				last.max = r.max
+			}
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	*p = merged
+}
+
+func (p portRanges) Covers(min, max int) bool {
+	for _, r := range p {
+		if r.min <= min && min <= r.max {
+			if max <= r.max {
+				return true
+			}
+			min = r.max + 1
+		}
+	}
+	return false
+}
+
+func (p portRanges) Contains(port int) bool {
+	i := sort.Search(len(p), func(i int) bool { return p[i].max >= port })
+	return i < len(p) && p[i].min <= port
+}
+
+// the parts of min-max that aren't covered
+func (p portRanges) Uncovered(min, max int) portRanges {
+	var rs portRanges
+	for _, r := range p {
+		if r.max < min || r.min > max {
+			continue
+		}
+		if r.min > min {
+			rs = append(rs, portRange{min, r.min - 1})
+		}
+		min = r.max + 1
+	}
+	if min <= max {
+		rs = append(rs, portRange{min, max})
+	}
+	return rs
+}
+
+// a run of address wildcard rules, as port tables, followed by the
+// rule for an address (nil for the last run)
+type policyStep struct {
+	decided  portRanges
+	accepted portRanges
+	rule     *Rule
+}
+
+// a policy with its rules compiled for quick evaluation. the rules
+// are split at each one that depends on the target address, and the
+// wildcard rules between them are worked out up front as the ports
+// they decide and which of those they accept
+type compiledPolicy struct {
+	*Policy
+	steps []policyStep
+}
+
+func compilePolicy(p *Policy) compiledPolicy {
+	c := compiledPolicy{Policy: p}
+	var step policyStep
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.IsAddressWildcard {
+			step.rule = r
+			c.steps = append(c.steps, step)
+			step = policyStep{}
+			continue
+		}
+		// first match wins, so a rule only decides the ports no
+		// earlier rule in the run did. earlier runs have returned
+		// for the ports they decide
+		if r.IsAccept {
+			for _, u := range step.decided.Uncovered(r.MinPort, r.MaxPort) {
+				step.accepted.Add(u.min, u.max)
+			}
+		}
+		step.decided.Add(r.MinPort, r.MaxPort)
+	}
+
+	// and the default decides the rest
+	if p.IsAllowedDefault {
+		for _, u := range step.decided.Uncovered(0, 65535) {
+			step.accepted.Add(u.min, u.max)
+		}
+	}
+	step.decided = portRanges{{0, 65535}}
+	c.steps = append(c.steps, step)
+	return c
+}
+
+// same answers as Policy.CanExit, ip is nil if the target didn't parse
+func (c *compiledPolicy) CanExit(ip net.IP, port int) bool {
+	if ip == nil || !ValidPort(port) {
+		return c.IsAllowedDefault
+	}
+	for i := range c.steps {
+		s := &c.steps[i]
+		if s.decided.Contains(port) {
+			return s.accepted.Contains(port)
+		}
+		if s.rule != nil && s.rule.IsMatch(ip, port) {
+			return s.rule.IsAccept
+		}
+	}
+	return c.IsAllowedDefault
+}
+
+// mirrors stem's ExitPolicy.is_exiting_allowed: true if some port is
+// accepted before everything has been rejected
+func IsExitingAllowed(rules []Rule, isAllowedDefault bool) bool {
+	var rejected portRanges
+	for _, r := range rules {
+		if r.IsAccept {
+			if !rejected.Covers(r.MinPort, r.MaxPort) {
+				return true
+			}
+		} else if r.IsAddressWildcard {
+			if IsPortWildcard(r) {
+				return false
+			}
+			rejected.Add(r.MinPort, r.MaxPort)
+		}
+	}
+	return isAllowedDefault && !rejected.Covers(1, 65535)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const DefaultTrustedProxies = "127.0.0.0/8,::1/128"
+
+// the proxies whose forwarding header GetHost believes, set from
+// -trusted-proxies
+var TrustedProxies = MustParseCIDRList(DefaultTrustedProxies)
+
+// what Apache's mod_proxy appends to
+const DefaultForwardedHeader = "X-Forwarded-For"
+
+// the one header the trusted proxies set the client address in, set
+// from -forwarded-header
+var ForwardedHeader = DefaultForwardedHeader
+
+var forwardedHeaders = []string{"X-Forwarded-For", "Forwarded", "X-Real-IP"}
+
+// the canonical name of a header ClientIP can read, such as
+// -forwarded-header
+func ParseForwardedHeader(s string) (string, error) {
+	for _, h := range forwardedHeaders {
+		if strings.EqualFold(strings.TrimSpace(s), h) {
+			return h, nil
+		}
+	}
+	return "", fmt.Errorf("%q isn't one of %s", s, strings.Join(forwardedHeaders, ", "))
+}
+
+// parses a comma separated list of addresses and cidrs, such as
+// -trusted-proxies
+func ParseCIDRList(s string) (*IPTree, error) {
+	tree := new(IPTree)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if len(p) == 0 {
+			continue
+		}
+		if strings.Contains(p, "/") {
+			_, ipNet, err := net.ParseCIDR(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address or CIDR %q", p)
+			}
+			tree.InsertNet(ipNet, true)
+			continue
+		}
+		ip := ParseAddress(p)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", p)
+		}
+		tree.Insert(ip, 8*len(ip), true)
+	}
+	return tree, nil
+}
+
+func MustParseCIDRList(s string) *IPTree {
+	tree, err := ParseCIDRList(s)
+	if err != nil {
+		panic(err)
+	}
+	return tree
+}
+
+// splits on sep, except inside quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var (
+		parts  []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i += 1
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i += 1
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// the address of a forwarded node, "192.0.2.43", "192.0.2.43:4711" or
+// "[2001:db8::17]:4711". unknown and obfuscated nodes come back empty
+func forwardedNode(node string) string {
+	if strings.EqualFold(node, "unknown") || strings.HasPrefix(node, "_") {
+		return ""
+	}
+	if strings.HasPrefix(node, "[") {
+		if i := strings.Index(node, "]"); i > 0 {
+			return node[1:i]
+		}
+		return ""
+	}
+	if strings.Count(node, ":") == 1 {
+		return node[:strings.Index(node, ":")]
+	}
+	return node
+}
+
+// the for= addresses of the Forwarded header (RFC 7239), client first
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			var addr string
+			for _, pair := range splitQuoted(element, ';') {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					addr = forwardedNode(unquote(strings.TrimSpace(kv[1])))
+				}
+			}
+			chain = append(chain, addr)
+		}
+	}
+	return chain
+}
+
+// the addresses the request passed through before reaching the last
+// proxy, client first, from the header the proxies write. the others
+// are passed along as the client sent them, so they're never read
+func forwardedChain(h http.Header, header string) []string {
+	key := http.CanonicalHeaderKey(header)
+	values := h[key]
+	if len(values) == 0 {
+		return nil
+	}
+	switch key {
+	case "Forwarded":
+		return parseForwarded(values)
+	case "X-Real-Ip":
+		// set by the last proxy, anything before it is the client's
+		return values[len(values)-1:]
+	}
+	var chain []string
+	for _, v := range values {
+		chain = append(chain, strings.Split(v, ",")...)
+	}
+	return chain
+}
+
+// the client's address. header is only believed when the request comes
+// from a trusted proxy, and then the chain is walked from the right,
+// past any other trusted proxies, to the first address we can't vouch
+// for. anything before that could have been made up
+func ClientIP(r *http.Request, trusted *IPTree, header string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	ip := ParseAddress(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid remote address %q", host)
+	}
+
+	chain := forwardedChain(r.Header, header)
+	for i := len(chain) - 1; i >= 0 && trusted.Contains(ip); i-- {
+		if ip = ParseAddress(chain[i]); ip == nil {
+			return nil, fmt.Errorf("invalid forwarded address %q", strings.TrimSpace(chain[i]))
+		}
+	}
+	return ip, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseCIDRList(t *testing.T) {
+	tree, err := ParseCIDRList(" 10.0.0.0/8, 192.0.2.1 ,2001:db8::/32,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, expected := range map[string]bool{
+		"10.1.2.3":         true,
+		"192.0.2.1":        true,
+		"::ffff:192.0.2.1": true,
+		"192.0.2.2":        false,
+		"2001:db8::1":      true,
+		"2001:db9::1":      false,
+	} {
+		if tree.Contains(ParseAddress(addr)) != expected {
+			t.Errorf("Expected %s trusted to be %v", addr, expected)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "proxy.example.com", "1.2.3"} {
+		if _, err := ParseCIDRList(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	tests := map[string][]string{
+		`for=192.0.2.60;proto=http`:            {"192.0.2.60"},
+		`for="[2001:db8:cafe::17]:4711"`:       {"2001:db8:cafe::17"},
+		`for="192.0.2.43:47011", for=10.0.0.2`: {"192.0.2.43", "10.0.0.2"},
+		`for=unknown`:                          {""},
+		`for=UNKNOWN, for=10.0.0.2`:            {"", "10.0.0.2"},
+		`for=_hidden, for="_SEVKISEK:4711"`:    {"", ""},
+		`for="[2001:db8::1"`:                   {""},
+		`proto=https`:                          {""},
+	}
+	for header, expected := range tests {
+		if got := parseForwarded([]string{header}); strings.Join(got, ",") != strings.Join(expected, ",") || len(got) != len(expected) {
+			t.Errorf("Got %q for %s, expected %q", got, header, expected)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := MustParseCIDRList("127.0.0.0/8,::1,10.0.0.0/8")
+	const (
+		xff      = "X-Forwarded-For"
+		fwd      = "Forwarded"
+		realIP   = "X-Real-IP"
+		exitAddr = "185.220.101.5"
+	)
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"direct", xff, "1.2.3.4:1234", nil, "1.2.3.4"},
+		{"spoofed", xff, "1.2.3.4:1234", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "1.2.3.4"},
+		{"spoofed forwarded", fwd, "1.2.3.4:1234", map[string]string{"Forwarded": "for=5.6.7.8"}, "1.2.3.4"},
+		{"spoofed real ip", realIP, "[2001:db8::1]:1234", map[string]string{"X-Real-IP": "5.6.7.8"}, "2001:db8::1"},
+		{"proxied", xff, "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		{"proxied over ipv6", xff, "[::1]:1234", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		{"client spoofs the chain", xff, "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8"}, "5.6.7.8"},
+		{"chain of proxies", xff, "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.2"}, "5.6.7.8"},
+		{"all trusted", xff, "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"no header", xff, "127.0.0.1:1234", nil, "127.0.0.1"},
+		{"garbage", xff, "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "5.6.7.8, garbage"}, ""},
+		{"garbage beyond the client", xff, "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "garbage, 5.6.7.8"}, "5.6.7.8"},
+		{"forwarded", fwd, "127.0.0.1:1234", map[string]string{"Forwarded": `for=192.0.2.60;proto=http;by=203.0.113.43`}, "192.0.2.60"},
+		{"forwarded ipv6", fwd, "127.0.0.1:1234", map[string]string{"Forwarded": `For="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"forwarded with port", fwd, "127.0.0.1:1234", map[string]string{"Forwarded": `for="192.0.2.43:47011"`}, "192.0.2.43"},
+		{"forwarded chain", fwd, "127.0.0.1:1234", map[string]string{"Forwarded": `for=9.9.9.9, for=192.0.2.43, for=10.0.0.2;by="[::1]"`}, "192.0.2.43"},
+		{"forwarded quoted comma", fwd, "127.0.0.1:1234", map[string]string{"Forwarded": `for=192.0.2.43;ext="a,b"`}, "192.0.2.43"},
+		{"forwarded unknown", fwd, "127.0.0.1:1234", map[string]string{"Forwarded": `for=unknown`}, ""},
+		{"forwarded obfuscated", fwd, "127.0.0.1:1234", map[string]string{"Forwarded": `for=_hidden, for=10.0.0.2`}, ""},
+		{"real ip", realIP, "127.0.0.1:1234", map[string]string{"X-Real-IP": " ::ffff:5.6.7.8 "}, "5.6.7.8"},
+		// a trusted proxy passing on headers the client made up, only the
+		// one the proxy writes counts
+		{"client forwarded", xff, "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9", "Forwarded": "for=" + exitAddr}, "203.0.113.9"},
+		{"client real ip", xff, "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9", "X-Real-IP": exitAddr}, "203.0.113.9"},
+		{"client forwarded only", xff, "127.0.0.1:1234", map[string]string{"Forwarded": "for=" + exitAddr, "X-Real-IP": exitAddr}, "127.0.0.1"},
+		{"client x-forwarded-for", realIP, "127.0.0.1:1234", map[string]string{"X-Forwarded-For": exitAddr, "X-Real-IP": "203.0.113.9"}, "203.0.113.9"},
+		{"client x-forwarded-for only", fwd, "127.0.0.1:1234", map[string]string{"X-Forwarded-For": exitAddr}, "127.0.0.1"},
+	}
+	for _, x := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = x.remoteAddr
+		for k, v := range x.headers {
+			r.Header.Set(k, v)
+		}
+		ip, err := ClientIP(r, trusted, x.header)
+		got := ""
+		if ip != nil {
+			got = ip.String()
+		}
+		if got != x.expected || (err != nil) != (x.expected == "") {
+			t.Errorf("%s: got %q, %v, expected %q", x.name, got, err, x.expected)
+		}
+	}
+
+	// repeated headers are one list
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Add("X-Forwarded-For", "5.6.7.8")
+	r.Header.Add("X-Forwarded-For", "10.0.0.2")
+	if ip, err := ClientIP(r, trusted, xff); err != nil || ip.String() != "5.6.7.8" {
+		t.Errorf("Got %v, %v", ip, err)
+	}
+
+	// a proxy that adds X-Real-IP rather than replacing it sets the last
+	r = httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Add("X-Real-IP", exitAddr)
+	r.Header.Add("X-Real-IP", "5.6.7.8")
+	if ip, err := ClientIP(r, trusted, realIP); err != nil || ip.String() != "5.6.7.8" {
+		t.Errorf("Got %v, %v", ip, err)
+	}
+}
+
+func TestParseForwardedHeader(t *testing.T) {
+	for in, expected := range map[string]string{
+		"x-forwarded-for": "X-Forwarded-For",
+		" Forwarded ":     "Forwarded",
+		"X-REAL-IP":       "X-Real-IP",
+	} {
+		if got, err := ParseForwardedHeader(in); err != nil || got != expected {
+			t.Errorf("Got %q, %v for %q, expected %q", got, err, in, expected)
+		}
+	}
+	for _, bad := range []string{"", "X-Client-IP", "X-Forwarded-For, Forwarded"} {
+		if _, err := ParseForwardedHeader(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
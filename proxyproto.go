@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// how long an upstream has to send the PROXY header
+const ProxyHeaderTimeout = 5 * time.Second
+
+// accepts HAProxy's PROXY protocol, v1 or v2, from the upstream
+// addresses. connections from them must start with the header, and the
+// address in it becomes the connection's RemoteAddr. other connections
+// are left alone
+type ProxyListener struct {
+	net.Listener
+	Upstream *IPTree
+	Timeout  time.Duration
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.Upstream.Contains(addr.IP) {
+		return c, nil
+	}
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = ProxyHeaderTimeout
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), timeout: timeout}, nil
+}
+
+// reads the header on first use, so a slow upstream doesn't hold up
+// Accept
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	remote  net.Addr
+	err     error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remote, c.err = ReadProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("proxy protocol from %v: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remote
+}
+
+// reads a v1 or v2 header. the address is nil for LOCAL and UNKNOWN
+// connections, such as health checks, which keep the upstream's
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if len(sig) >= 6 && string(sig[:6]) == "PROXY " {
+		return readProxyV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("missing header")
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// the longest header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s := string(line)
+	if !strings.HasSuffix(s, "\r\n") {
+		return nil, fmt.Errorf("invalid v1 header %q", s)
+	}
+	fields := strings.Split(strings.TrimSuffix(s, "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", s)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || net.ParseIP(fields[3]) == nil {
+		return nil, fmt.Errorf("invalid v1 header %q", s)
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil || port < 0 || port > 65535 || fields[4] != strconv.Itoa(port) {
+		return nil, fmt.Errorf("invalid v1 header %q", s)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0xf {
+	case 0:
+		// LOCAL
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", header[12]&0xf)
+	}
+
+	// the address family, the transport is ignored. anything after
+	// the addresses is TLVs we don't need
+	var size int
+	switch header[13] >> 4 {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, fmt.Errorf("short v2 address block")
+	}
+	ip := make(net.IP, size)
+	copy(ip, body[:size])
+	port := int(binary.BigEndian.Uint16(body[2*size : 2*size+2]))
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
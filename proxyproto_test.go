@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(command byte, family byte, addrs []byte) string {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:16], uint16(len(addrs)))
+	return string(append(h, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0x57, 0, 80}
+	v6 := append(append(append([]byte{}, ParseAddress("2001:db8::1").To16()...), ParseAddress("2001:db8::2").To16()...), 0x04, 0x57, 0, 80)
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{"v1 tcp4", "PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\n", "1.2.3.4:1111"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 1111 80\r\n", "[2001:db8::1]:1111"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", ""},
+		{"v1 unknown with addresses", "PROXY UNKNOWN 1.2.3.4 5.6.7.8 1111 80\r\n", ""},
+		{"v2 tcp4", proxyV2Header(1, 0x11, v4), "1.2.3.4:1111"},
+		{"v2 tcp6", proxyV2Header(1, 0x21, v6), "[2001:db8::1]:1111"},
+		{"v2 udp4", proxyV2Header(1, 0x12, v4), "1.2.3.4:1111"},
+		{"v2 with tlvs", proxyV2Header(1, 0x11, append(append([]byte{}, v4...), 0x04, 0, 1, 'x')), "1.2.3.4:1111"},
+		{"v2 local", proxyV2Header(0, 0x00, nil), ""},
+		{"v2 unspec", proxyV2Header(1, 0x00, nil), ""},
+	}
+	for _, x := range tests {
+		r := bufio.NewReader(strings.NewReader(x.header + "GET / HTTP/1.0\r\n"))
+		addr, err := ReadProxyHeader(r)
+		if err != nil {
+			t.Errorf("%s: %v", x.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != x.expected {
+			t.Errorf("%s: got %q, expected %q", x.name, got, x.expected)
+		}
+		// the rest is left for the request
+		if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.0\r\n" {
+			t.Errorf("%s: left %q", x.name, rest)
+		}
+	}
+
+	bad := map[string]string{
+		"no header":       "GET / HTTP/1.0\r\n",
+		"v1 family":       "PROXY TCP5 1.2.3.4 5.6.7.8 1111 80\r\n",
+		"v1 mismatch":     "PROXY TCP6 1.2.3.4 5.6.7.8 1111 80\r\n",
+		"v1 address":      "PROXY TCP4 1.2.3 5.6.7.8 1111 80\r\n",
+		"v1 port":         "PROXY TCP4 1.2.3.4 5.6.7.8 70000 80\r\n",
+		"v1 fields":       "PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\n",
+		"v1 no crlf":      "PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\n",
+		"v1 too long":     "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		"v2 version":      strings.Replace(proxyV2Header(1, 0x11, v4), "\x21\x11", "\x31\x11", 1),
+		"v2 command":      proxyV2Header(2, 0x11, v4),
+		"v2 short":        proxyV2Header(1, 0x21, v4),
+		"v2 truncated":    proxyV2Header(1, 0x11, v4)[:20],
+		"truncated start": "PRO",
+	}
+	for name, header := range bad {
+		if _, err := ReadProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func serveProxyProtocol(t *testing.T, upstream string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := &ProxyListener{Listener: l, Upstream: MustParseCIDRList(upstream), Timeout: 200 * time.Millisecond}
+	go http.Serve(pl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	}))
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func proxyRequest(t *testing.T, addr string, header string) string {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Write([]byte(header + "GET / HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(c)
+	return string(b)
+}
+
+func TestProxyListener(t *testing.T) {
+	addr, stop := serveProxyProtocol(t, "127.0.0.1")
+	defer stop()
+
+	if resp := proxyRequest(t, addr, "PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\n"); !strings.HasSuffix(resp, "\r\n\r\n1.2.3.4:1111") {
+		t.Errorf("Got %q", resp)
+	}
+	if resp := proxyRequest(t, addr, "PROXY UNKNOWN\r\n"); !strings.Contains(resp, "\r\n\r\n127.0.0.1:") {
+		t.Errorf("Got %q", resp)
+	}
+	// upstreams have to send the header
+	if resp := proxyRequest(t, addr, ""); len(resp) > 0 {
+		t.Errorf("Got %q", resp)
+	}
+
+	// and no one else can
+	addr, stop = serveProxyProtocol(t, "10.0.0.0/8")
+	defer stop()
+	if resp := proxyRequest(t, addr, "PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 400") {
+		t.Errorf("Got %q", resp)
+	}
+	if resp := proxyRequest(t, addr, ""); !strings.Contains(resp, "\r\n\r\n127.0.0.1:") {
+		t.Errorf("Got %q", resp)
+	}
+}
+
+func TestProxyListenerTimeout(t *testing.T) {
+	addr, stop := serveProxyProtocol(t, "127.0.0.1")
+	defer stop()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4"))
+
+	// a stalled upstream is hung up on
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("Expected the connection to be closed, got %d, %v", n, err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Error("Took too long to hang up")
+	}
+}
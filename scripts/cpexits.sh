@@ -14,5 +14,5 @@ cp $TORDATA/cached-consensus $CHECK/data/consensuses/$NOW-consensus
 cat $TORDATA/cached-descriptors $TORDATA/cached-descriptors.new > $CHECK/data/cached-descriptors
 
 cd $CHECK
-scripts/exitips.py -n 1
+/usr/local/bin/check build-exits -base $CHECK -n 1
 kill -s SIGUSR2 `cat check.pid`
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how long in-flight requests get to finish on SIGTERM or SIGINT
+const DefaultShutdownTimeout = 30 * time.Second
+
+// check sees tens of millions of hits, so bound how long and how many
+// connections a client can hold on to
+type ServerLimits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// concurrent connections, 0 for no cap
+	MaxConns int
+}
+
+// the write timeout is generous for slow clients fetching the bulk list
+var DefaultServerLimits = ServerLimits{
+	ReadHeaderTimeout: 5 * time.Second,
+	ReadTimeout:       30 * time.Second,
+	WriteTimeout:      60 * time.Second,
+	IdleTimeout:       120 * time.Second,
+	MaxHeaderBytes:    32 << 10,
+	MaxConns:          10000,
+}
+
+func (s ServerLimits) Server(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+		MaxHeaderBytes:    s.MaxHeaderBytes,
+	}
+}
+
+func (s ServerLimits) Listener(l net.Listener) net.Listener {
+	if s.MaxConns <= 0 {
+		return l
+	}
+	return &LimitListener{Listener: l, sem: make(chan struct{}, s.MaxConns)}
+}
+
+// stops accepting while MaxConns connections are open, the rest wait in
+// the kernel's backlog
+type LimitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *LimitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// the first passed fd, see sd_listen_fds(3)
+const listenFdsStart = 3
+
+// set on the new process by Upgrade, so it stops us once it's serving
+const takeoverEnv = "CHECK_TAKEOVER"
+
+// what each passed listener is for, named in LISTEN_FDNAMES
+const (
+	listenerHTTP     = "http"
+	listenerRedirect = "redirect"
+	listenerAdmin    = "admin"
+)
+
+// the order systemd passes them in when the sockets aren't named with
+// FileDescriptorName=
+var listenerOrder = []string{listenerHTTP, listenerRedirect, listenerAdmin}
+
+// the names for n passed listeners, from LISTEN_FDNAMES if they're all
+// ours, otherwise by position
+func listenerNames(fdNames string, n int) ([]string, error) {
+	names := strings.Split(fdNames, ":")
+	seen := make(map[string]bool)
+	for _, name := range names {
+		known := false
+		for _, x := range listenerOrder {
+			known = known || name == x
+		}
+		if !known || seen[name] {
+			names = nil
+			break
+		}
+		seen[name] = true
+	}
+	if len(names) == n {
+		return names, nil
+	}
+	if n > len(listenerOrder) {
+		return nil, fmt.Errorf("passed %d listeners, expected at most %d", n, len(listenerOrder))
+	}
+	return listenerOrder[:n], nil
+}
+
+// listeners passed in by systemd socket activation, or by the process
+// we're taking over from, by what they're for. LISTEN_FDS sockets start
+// at fd 3 and are meant for us if LISTEN_PID is our pid, or unset when
+// we were started by Upgrade
+func InheritedListeners() (map[string]net.Listener, error) {
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	names, err := listenerNames(os.Getenv("LISTEN_FDNAMES"), n)
+	// not for our children
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		return nil, err
+	}
+
+	ls := make(map[string]net.Listener, n)
+	for i, name := range names {
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), name)
+		// dups the fd close-on-exec
+		ls[name], err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited fd %d (%s): %v", fd, name, err)
+		}
+	}
+	return ls, nil
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// starts path with args and the listeners passed as LISTEN_FDS, named in
+// LISTEN_FDNAMES. unix sockets are left on disk when we close ours, the
+// new process serves them now
+func spawnWithListeners(path string, args []string, env []string, ls map[string]net.Listener) (*os.Process, error) {
+	var names []string
+	for _, name := range listenerOrder {
+		if _, ok := ls[name]; ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) != len(ls) {
+		return nil, fmt.Errorf("can only pass listeners named %v", listenerOrder)
+	}
+	files := make([]*os.File, len(names))
+	for i, name := range names {
+		fl, ok := ls[name].(filer)
+		if !ok {
+			return nil, fmt.Errorf("can't pass a %T", ls[name])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		files[i] = f
+	}
+
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, "LISTEN_FDS="+strconv.Itoa(len(names)), "LISTEN_FDNAMES="+strings.Join(names, ":"))
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	for _, l := range ls {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process, nil
+}
+
+// starts a new copy of the (possibly replaced) binary with the same
+// arguments on our listeners. we keep serving until it sends us SIGTERM
+// from TakeOver, so no connection is refused while it loads the exit list
+func Upgrade(ls map[string]net.Listener) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return spawnWithListeners(path, os.Args[1:], []string{takeoverEnv + "=1"}, ls)
+}
+
+// called once we're serving, stops the process that started us by Upgrade
+func TakeOver() error {
+	if os.Getenv(takeoverEnv) != "1" {
+		return nil
+	}
+	os.Unsetenv(takeoverEnv)
+	return syscall.Kill(os.Getppid(), syscall.SIGTERM)
+}
+
+// stops the servers accepting and waits up to timeout for the requests
+// in flight to finish
+func Drain(timeout time.Duration, servers ...*http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			errs <- srv.Shutdown(ctx)
+		}(srv)
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func WritePid(pidPath string) error {
+	return ioutil.WriteFile(pidPath, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// only if it's still ours, after an upgrade it's the new process's
+func RemovePid(pidPath string) error {
+	b, err := ioutil.ReadFile(pidPath)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	return os.Remove(pidPath)
+}
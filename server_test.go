@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+	go srv.Serve(l)
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- Drain(5*time.Second, srv)
+	}()
+
+	// no longer accepting, but the request in flight finishes
+	waitFor(t, "the listener to close", func() bool {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	})
+	close(release)
+	if b := <-body; b != "done" {
+		t.Errorf("Got %q, expected done", b)
+	}
+	if err = <-drained; err != nil {
+		t.Errorf("Drain: %v", err)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	go srv.Serve(l)
+	go http.Get("http://" + l.Addr().String())
+	<-started
+
+	if err = Drain(20*time.Millisecond, srv); err != context.DeadlineExceeded {
+		t.Errorf("Got %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+// run by TestInheritedListeners as the new process, it answers one
+// connection on each listener with the listener's name
+func TestHelperInherited(t *testing.T) {
+	if os.Getenv("CHECK_TEST_HELPER") != "1" {
+		return
+	}
+	ls, err := InheritedListeners()
+	if err != nil || len(ls) != 2 || ls[listenerHTTP] == nil || ls[listenerAdmin] == nil {
+		os.Exit(1)
+	}
+	if len(os.Getenv("LISTEN_FDS")) > 0 || len(os.Getenv("LISTEN_FDNAMES")) > 0 {
+		os.Exit(2)
+	}
+	for _, name := range []string{listenerHTTP, listenerAdmin} {
+		c, err := ls[name].Accept()
+		if err != nil {
+			os.Exit(3)
+		}
+		c.Write([]byte(name + "\n"))
+		c.Close()
+	}
+	os.Exit(0)
+}
+
+func expectLine(t *testing.T, c net.Conn, expected string) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != expected+"\n" {
+		t.Errorf("Got %q, %v, expected %s", line, err, expected)
+	}
+}
+
+// an upgrade with the admin endpoint on a unix socket
+func TestInheritedListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := path.Join(dir, "admin.sock")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := ListenAdmin("unix:" + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a connection queued before the handover is served by the new process
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ls := map[string]net.Listener{listenerHTTP: l, listenerAdmin: admin}
+	p, err := spawnWithListeners(os.Args[0], []string{"-test.run=^TestHelperInherited$"}, []string{"CHECK_TEST_HELPER=1"}, ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as when the old process exits, the socket stays for the new one
+	l.Close()
+	admin.Close()
+
+	expectLine(t, c, listenerHTTP)
+	ac, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	expectLine(t, ac, listenerAdmin)
+
+	state, err := p.Wait()
+	if err != nil || !state.Success() {
+		t.Errorf("Helper exited with %v, %v", state, err)
+	}
+}
+
+func TestListenerNames(t *testing.T) {
+	tests := []struct {
+		fdNames  string
+		n        int
+		expected string
+	}{
+		{"http:admin", 2, "http admin"},
+		{"admin", 1, "admin"},
+		// systemd's defaults are the socket unit's name
+		{"check.socket:check.socket", 2, "http redirect"},
+		{"", 1, "http"},
+		{"http:http", 2, "http redirect"},
+		{"http", 3, "http redirect admin"},
+	}
+	for _, x := range tests {
+		names, err := listenerNames(x.fdNames, x.n)
+		if err != nil || strings.Join(names, " ") != x.expected {
+			t.Errorf("Got %v, %v for %q, expected %s", names, err, x.fdNames, x.expected)
+		}
+	}
+	if _, err := listenerNames("", 4); err == nil {
+		t.Error("Expected an error for too many listeners")
+	}
+}
+
+func TestInheritedListenersOtherPid(t *testing.T) {
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_PID")
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_PID", "1")
+	ls, err := InheritedListeners()
+	if err != nil || ls != nil {
+		t.Errorf("Got %v, %v, expected nothing", ls, err)
+	}
+}
+
+func TestRemovePid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidPath := path.Join(dir, "check.pid")
+
+	// taken over by a new process
+	if err = ioutil.WriteFile(pidPath, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = RemovePid(pidPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(pidPath); err != nil {
+		t.Errorf("Removed another process's pid file: %v", err)
+	}
+
+	if err = WritePid(pidPath); err != nil {
+		t.Fatal(err)
+	}
+	if err = RemovePid(pidPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(pidPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the pid file to be removed, got %v", err)
+	}
+}
+
+func serveLimited(t *testing.T, limits ServerLimits) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := limits.Server(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	go srv.Serve(limits.Listener(l))
+	return l.Addr().String(), func() { srv.Close() }
+}
+
+// how long until the server hangs up on a client that stops at partial
+func hangsUpAfter(t *testing.T, addr string, partial string) time.Duration {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err = c.Write([]byte(partial)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ioutil.ReadAll(c)
+	return time.Since(start)
+}
+
+func TestServerLimitsSlowHeaders(t *testing.T) {
+	limits := ServerLimits{ReadHeaderTimeout: 50 * time.Millisecond}
+	addr, stop := serveLimited(t, limits)
+	defer stop()
+	if d := hangsUpAfter(t, addr, "GET / HTTP/1.1\r\nHost: localhost\r\n"); d > 2*time.Second {
+		t.Errorf("Slow headers held the connection for %v", d)
+	}
+}
+
+func TestServerLimitsSlowBody(t *testing.T) {
+	limits := ServerLimits{ReadTimeout: 50 * time.Millisecond}
+	addr, stop := serveLimited(t, limits)
+	defer stop()
+	if d := hangsUpAfter(t, addr, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\nabc"); d > 2*time.Second {
+		t.Errorf("A slow body held the connection for %v", d)
+	}
+}
+
+func TestServerLimitsIdle(t *testing.T) {
+	limits := ServerLimits{IdleTimeout: 50 * time.Millisecond}
+	addr, stop := serveLimited(t, limits)
+	defer stop()
+	if d := hangsUpAfter(t, addr, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); d > 2*time.Second {
+		t.Errorf("An idle keep-alive connection was held for %v", d)
+	}
+}
+
+func TestServerLimitsHeaderBytes(t *testing.T) {
+	limits := ServerLimits{MaxHeaderBytes: 1 << 10}
+	addr, stop := serveLimited(t, limits)
+	defer stop()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	big := "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: " + strings.Repeat("a", 8<<10) + "\r\n\r\n"
+	if _, err = c.Write([]byte(big)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Got %d, expected %d", resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+}
+
+func TestServerLimitsMaxConns(t *testing.T) {
+	limits := ServerLimits{MaxConns: 1}
+	addr, stop := serveLimited(t, limits)
+	defer stop()
+
+	get := func(c net.Conn, wait time.Duration) error {
+		if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+			return err
+		}
+		c.SetReadDeadline(time.Now().Add(wait))
+		_, err := http.ReadResponse(bufio.NewReader(c), nil)
+		return err
+	}
+
+	// a keep-alive connection takes the only slot
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = get(first, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next one waits in the backlog
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if err = get(second, 100*time.Millisecond); err == nil {
+		t.Fatal("Expected the second connection to wait")
+	}
+
+	// and is served once the first goes away
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(second), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Got %v, %v, expected the second connection to be served", resp, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// the merged state of a generation: every exit we still remember, with
+// all its addresses and how long ago it was seen, and TorDNSEL's
+// measurements. exit-policies only has the last build's window, so a
+// restart restores this instead of starting over
+type Snapshot struct {
+	UpdateTime    time.Time
+	Policies      []Policy
+	ExitAddresses map[string][]ExitAddress
+}
+
+func (d *ExitData) Snapshot() Snapshot {
+	return Snapshot{
+		UpdateTime:    d.UpdateTime.UTC(),
+		Policies:      d.Policies(),
+		ExitAddresses: d.ExitAddresses,
+	}
+}
+
+// replaces the file at snapshotPath atomically
+func WriteSnapshot(snapshotPath string, s Snapshot) error {
+	return writeFileAtomic(snapshotPath, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(s)
+	})
+}
+
+// the policies are checked like ParsePolicies does
+func ReadSnapshot(snapshotPath string) (*Snapshot, error) {
+	f, err := os.Open(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := new(Snapshot)
+	if err = json.NewDecoder(f).Decode(s); err != nil {
+		return nil, fmt.Errorf("%s: %v", snapshotPath, err)
+	}
+	for i := range s.Policies {
+		p := &s.Policies[i]
+		for j := range p.Rules {
+			p.Rules[j].resolveAddress()
+		}
+		if err = validatePolicy(*p); err != nil {
+			return nil, fmt.Errorf("%s: policy %d: %v", snapshotPath, i+1, err)
+		}
+	}
+	return s, nil
+}
+
+// publishes the snapshot as it was, including when it was loaded, so
+// the next reload ages it like any other. it's already on disk and in
+// the history, so neither is written again
+func (e *Exits) Restore(s *Snapshot) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.data.Store(e.next(s.Policies, false, s.ExitAddresses, s.UpdateTime))
+}
+
+// restores the snapshot at SnapshotPath, if there is one. false if there
+// wasn't anything to restore
+func (e *Exits) restoreSnapshot() (bool, error) {
+	if len(e.SnapshotPath) == 0 {
+		return false, nil
+	}
+	s, err := ReadSnapshot(e.SnapshotPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	e.Restore(s)
+	return true, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const snapshotTestData = `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1"}
+{"Rules": [{"IsAccept": false, "MinPort": 1, "MaxPort": 65535, "Address": "10.0.0.0", "Mask": "255.0.0.0"}, {"IsAccept": true, "MinPort": 1, "MaxPort": 65535, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["222.222.222.222"], "Fingerprint": "2"}`
+
+// the second exit has dropped out of the latest build
+var snapshotTestUpdate = strings.SplitN(snapshotTestData, "\n", 2)[0]
+
+func dumpString(e *Exits, ip string, port int) string {
+	var buf bytes.Buffer
+	e.Dump(&buf, 16, ip, port)
+	return buf.String()
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotPath := path.Join(dir, "snapshot")
+	policies := path.Join(dir, "exit-policies")
+
+	exits := &Exits{SnapshotPath: snapshotPath}
+	if err = exits.Load(strings.NewReader(snapshotTestData), false); err != nil {
+		t.Fatal(err)
+	}
+	if err = exits.Load(strings.NewReader(snapshotTestUpdate), true); err != nil {
+		t.Fatal(err)
+	}
+	before := exits.Current()
+
+	// a restart with only the latest build on disk
+	if err = ioutil.WriteFile(policies, []byte(snapshotTestUpdate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a couple of hours later, just after the build was written
+	later := time.Now().Add(2*time.Hour + 30*time.Minute)
+	if err = os.Chtimes(policies, later, later); err != nil {
+		t.Fatal(err)
+	}
+	restarted := &Exits{SnapshotPath: snapshotPath, now: func() time.Time { return later }}
+	if err = restarted.Run(policies, ""); err != nil {
+		t.Fatal(err)
+	}
+	restarted.assertIsTor(t, "111.111.111.111", true)
+	restarted.assertIsTor(t, "222.222.222.222", true)
+	if dump := dumpString(restarted, "8.8.8.8", 80); dump != "222.222.222.222\n" {
+		t.Errorf("Got %q", dump)
+	}
+	if dump := dumpString(restarted, "10.1.1.1", 443); dump != "111.111.111.111\n" {
+		t.Errorf("Got %q, expected the restored policy to still apply", dump)
+	}
+	if dump := dumpString(restarted, "8.8.8.8", 443); dump != dumpString(exits, "8.8.8.8", 443) {
+		t.Errorf("Got %q, expected %q", dump, dumpString(exits, "8.8.8.8", 443))
+	}
+
+	// the exit that dropped out is aged by the time that passed
+	for _, p := range restarted.Current().Policies() {
+		expected := 0
+		if p.Fingerprint == "2" {
+			expected = 2
+		}
+		if p.Tminus != expected {
+			t.Errorf("Got Tminus %d for %s, expected %d", p.Tminus, p.Fingerprint, expected)
+		}
+	}
+
+	// and it's saved again
+	s, err := ReadSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.UpdateTime.Equal(restarted.Current().UpdateTime) || !s.UpdateTime.After(before.UpdateTime) || len(s.Policies) != 2 {
+		t.Errorf("Got %+v", s)
+	}
+}
+
+func TestSnapshotWithoutExitList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotPath := path.Join(dir, "snapshot")
+	missing := path.Join(dir, "data/exit-policies")
+
+	// the config is only refused for the missing exit list without a
+	// snapshot to fall back on
+	c := DefaultConfig()
+	c.Base = dir
+	if err = c.Validate(); err == nil || !strings.Contains(err.Error(), "base: no exit list") {
+		t.Errorf("Got %v, expected the missing exit list to be refused", err)
+	}
+	c.Snapshot = snapshotPath
+	if err = c.Validate(); err != nil {
+		t.Errorf("Got %v, expected the snapshot to be enough", err)
+	}
+
+	// nothing to serve
+	if err = (&Exits{SnapshotPath: snapshotPath}).Run(missing, ""); err == nil {
+		t.Error("Expected an error without an exit list or a snapshot")
+	}
+
+	exits := &Exits{SnapshotPath: snapshotPath}
+	if err = exits.Load(strings.NewReader(snapshotTestData), false); err != nil {
+		t.Fatal(err)
+	}
+	saved := exits.Current().UpdateTime
+
+	restarted := &Exits{SnapshotPath: snapshotPath}
+	if err = restarted.Run(missing, ""); err != nil {
+		t.Fatal(err)
+	}
+	restarted.assertIsTor(t, "222.222.222.222", true)
+	// as old as it was, so it goes stale
+	if d := restarted.Current(); !d.UpdateTime.Equal(saved) || d.Generation != 1 {
+		t.Errorf("Got generation %d from %v, expected the snapshot from %v", d.Generation, d.UpdateTime, saved)
+	}
+	if restarted.ReloadStatus().Failures != 1 {
+		t.Error("Expected the failed load to be recorded")
+	}
+}
+
+// restoring doesn't write the snapshot back or record it again
+func TestSnapshotRestoreOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotPath := path.Join(dir, "snapshot")
+
+	exits := &Exits{SnapshotPath: snapshotPath}
+	if err = exits.Load(strings.NewReader(snapshotTestData), false); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err = os.Chtimes(snapshotPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := LoadHistory(path.Join(dir, "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := &Exits{SnapshotPath: snapshotPath, History: history}
+	if restored, err := restarted.restoreSnapshot(); !restored || err != nil {
+		t.Fatalf("Got %v, %v", restored, err)
+	}
+	restarted.assertIsTor(t, "222.222.222.222", true)
+	if info, err := os.Stat(snapshotPath); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("Expected the snapshot to be left alone, got %v", err)
+	}
+	if history.Len() != 0 {
+		t.Errorf("Got %d intervals, expected nothing recorded", history.Len())
+	}
+	if _, err = os.Stat(history.Path); !os.IsNotExist(err) {
+		t.Errorf("Got %v, expected the history not to be saved", err)
+	}
+}
+
+func TestSnapshotBroken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotPath := path.Join(dir, "snapshot")
+	policies := path.Join(dir, "exit-policies")
+	if err = ioutil.WriteFile(policies, []byte(snapshotTestUpdate), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	broken := []string{
+		`{"UpdateTime": "2026-01-01T00:00:00Z", "Policies": [`,
+		`{"UpdateTime": "2026-01-01T00:00:00Z", "Policies": [{"Rules": [], "Address": ["111.111.111.111"], "Fingerprint": ""}]}`,
+	}
+	for _, b := range broken {
+		if err = ioutil.WriteFile(snapshotPath, []byte(b), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ReadSnapshot(snapshotPath); err == nil {
+			t.Errorf("Expected an error reading %s", b)
+		}
+
+		// started over from the exit list
+		exits := &Exits{SnapshotPath: snapshotPath}
+		if err = exits.Run(policies, ""); err != nil {
+			t.Fatal(err)
+		}
+		exits.assertIsTor(t, "111.111.111.111", true)
+		exits.assertIsTor(t, "222.222.222.222", false)
+	}
+}
+
+func TestSnapshotSavedOutsideLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotPath := path.Join(dir, "snapshot")
+
+	exits := &Exits{SnapshotPath: snapshotPath}
+	if err = exits.Load(strings.NewReader(snapshotTestData), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a save stuck on the disk doesn't hold up the next generation
+	exits.saveMu.Lock()
+	done := make(chan struct{})
+	go func() {
+		exits.Load(strings.NewReader(snapshotTestUpdate), false)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for exits.Current().Generation != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Publishing waited on the snapshot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	exits.assertIsTor(t, "222.222.222.222", false)
+	exits.saveMu.Unlock()
+	<-done
+
+	// and the snapshot catches up
+	s, err := ReadSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Policies) != 1 {
+		t.Errorf("Got %d policies in the snapshot, expected 1", len(s.Policies))
+	}
+}
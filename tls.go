@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serves the certificate and key from disk, re-reading them on Reload.
+// only new handshakes see a new certificate, open connections carry on
+type CertReloader struct {
+	CertPath string
+	KeyPath  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func NewCertReloader(certPath string, keyPath string) (*CertReloader, error) {
+	c := &CertReloader{CertPath: certPath, KeyPath: keyPath}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// on error the previous certificate is kept
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.CertPath, c.KeyPath)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+func (c *CertReloader) reloadAndLog(why string) {
+	if err := c.Reload(); err != nil {
+		log.Printf("Reloading the certificate failed, keeping the previous one: %v", err)
+	} else {
+		log.Printf("Certificate reloaded (%s).", why)
+	}
+}
+
+// polls the certificate and key, reloading once they've changed like
+// Exits.Watch. stops when done is closed
+func (c *CertReloader) Watch(interval time.Duration, done <-chan struct{}) {
+	watchFiles([]string{c.CertPath, c.KeyPath}, interval, done, func() {
+		c.reloadAndLog("changed on disk")
+	})
+}
+
+// reloads on SIGHUP
+func (c *CertReloader) Run() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			c.reloadAndLog("SIGHUP")
+		}
+	}()
+}
+
+// sends plain http requests to the same host and path over https
+func RedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if ip := ParseAddress(host); ip != nil && isIPv6(ip) {
+			host = "[" + ip.String() + "]"
+		}
+		if httpsPort != 443 {
+			host += ":" + strconv.Itoa(httpsPort)
+		}
+		code := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writes a self-signed certificate for localhost with the serial
+func writeTestCert(t *testing.T, certPath string, keyPath string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written under temporary names and renamed, like certbot does
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	for p, b := range map[string][]byte{certPath: certPEM, keyPath: keyPEM} {
+		if err = ioutil.WriteFile(p+".tmp", b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Rename(p+".tmp", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func servingSerial(t *testing.T, c *CertReloader) int64 {
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+
+	if _, err = NewCertReloader(certPath, keyPath); err == nil {
+		t.Error("Expected an error without a certificate")
+	}
+
+	writeTestCert(t, certPath, keyPath, 1)
+	c, err := NewCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a connection made before the reload
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(tls.NewListener(l, c.TLSConfig()), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 1 {
+		t.Errorf("Got serial %d, expected 1", serial)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.Watch(10*time.Millisecond, done)
+	time.Sleep(50 * time.Millisecond)
+
+	writeTestCert(t, certPath, keyPath, 2)
+	waitFor(t, "the new certificate", func() bool {
+		return servingSerial(t, c) == 2
+	})
+
+	// new connections get the new certificate
+	conn2, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if serial := conn2.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("Got serial %d, expected 2", serial)
+	}
+	// and the old one is still open
+	if _, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := ioutil.ReadAll(conn); err != nil && len(b) == 0 {
+		t.Errorf("Old connection failed: %v", err)
+	}
+
+	// a broken certificate is ignored
+	if err = ioutil.WriteFile(certPath, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Reload(); err == nil {
+		t.Error("Expected an error reloading a broken certificate")
+	}
+	if serial := servingSerial(t, c); serial != 2 {
+		t.Errorf("Got serial %d, expected 2", serial)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		method   string
+		target   string
+		port     int
+		expected string
+		code     int
+	}{
+		{"GET", "http://check.example.com/?lang=de", 443, "https://check.example.com/?lang=de", http.StatusMovedPermanently},
+		{"GET", "http://check.example.com:80/api/ip", 8443, "https://check.example.com:8443/api/ip", http.StatusMovedPermanently},
+		{"GET", "http://[2001:db8::1]:80/torbulkexitlist?ip=1.2.3.4", 443, "https://[2001:db8::1]/torbulkexitlist?ip=1.2.3.4", http.StatusMovedPermanently},
+		{"POST", "http://check.example.com/api/ip", 443, "https://check.example.com/api/ip", http.StatusPermanentRedirect},
+	}
+	for _, x := range tests {
+		w := httptest.NewRecorder()
+		RedirectHandler(x.port).ServeHTTP(w, httptest.NewRequest(x.method, x.target, nil))
+		if w.Code != x.code || w.Header().Get("Location") != x.expected {
+			t.Errorf("Got %d to %s for %s %s, expected %d to %s", w.Code, w.Header().Get("Location"), x.method, x.target, x.code, x.expected)
+		}
+	}
+}
@@ -18,6 +18,31 @@ import (
 	"strings"
 )
 
+// replaces filePath with what write writes, through a temporary file in
+// the same directory so readers never see a partial file
+func writeFileAtomic(filePath string, write func(io.Writer) error) error {
+	tmp, err := ioutil.TempFile(path.Dir(filePath), "."+path.Base(filePath)+".")
+	if err != nil {
+		return err
+	}
+	if err = write(tmp); err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
 func IsParamSet(r *http.Request, param string) bool {
 	return len(r.URL.Query().Get(param)) > 0
 }
@@ -42,17 +67,51 @@ func GetQS(q url.Values, param string, deflt int) (num int, str string) {
 	return
 }
 
+// dotted quads with leading zeros, which net.ParseIP refuses. they're
+// read as decimal, like tor and most proxies do, not octal
+func trimLeadingZeros(s string) string {
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return s
+	}
+	for i, p := range parts {
+		if len(p) > 1 {
+			parts[i] = strings.TrimLeft(p, "0")
+			if len(parts[i]) == 0 {
+				parts[i] = "0"
+			}
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// parses an address more leniently than net.ParseIP: surrounding
+// brackets and space, zones and leading zeros are accepted. ipv4-mapped
+// ipv6 addresses come back as ipv4, so equivalent forms compare equal
+func ParseAddress(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	if i := strings.Index(s, "%"); i >= 0 && strings.Contains(s, ":") {
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, ":"); strings.Contains(s, ".") {
+		s = s[:i+1] + trimLeadingZeros(s[i+1:])
+	}
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
 func GetHost(r *http.Request) (host string, err error) {
-	// get remote ip
-	host = r.Header.Get("X-Forwarded-For")
-	if len(host) > 0 {
-		parts := strings.Split(host, ",")
-		// apache will append the remote address
-		host = strings.TrimSpace(parts[len(parts)-1])
-	} else {
-		host, _, err = net.SplitHostPort(r.RemoteAddr)
+	ip, err := ClientIP(r, TrustedProxies, ForwardedHeader)
+	if err != nil {
+		return "", err
 	}
-	return
+	return ip.String(), nil
 }
 
 var TBBUserAgents = regexp.MustCompile(`^Mozilla/5\.0 \([^)]*\) Gecko/([\d]+\.0|20100101) Firefox/[\d]+\.0$`)
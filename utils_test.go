@@ -1,6 +1,14 @@
 package main
 
-import "testing"
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
 
 var UserAgents = map[string]bool{
 	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.8; rv:10.0.2) Gecko/20100101 Firefox/10.0.2":                                    false,
@@ -27,3 +35,108 @@ func TestLikelyTBB(t *testing.T) {
 		}
 	}
 }
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{" 1.2.3.4\t", "1.2.3.4"},
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"::FFFF:1.2.3.4", "1.2.3.4"},
+		{"0:0:0:0:0:ffff:0102:0304", "1.2.3.4"},
+		{"001.002.003.004", "1.2.3.4"},
+		{"10.00.0.010", "10.0.0.10"},
+		{"::ffff:001.002.003.004", "1.2.3.4"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"2001:0DB8:0000:0000:0000:0000:0000:0001", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%25eth0]", "fe80::1"},
+		{"", ""},
+		{"1.2.3", ""},
+		{"1.2.3.256", ""},
+		{"0256.1.1.1", ""},
+		{"1.2.3.4%eth0", ""},
+		{"example.com", ""},
+		{"2001:db8::zz", ""},
+	}
+	for _, x := range tests {
+		ip := ParseAddress(x.in)
+		got := ""
+		if ip != nil {
+			got = ip.String()
+		}
+		if got != x.expected {
+			t.Errorf("ParseAddress(%q) = %q, expected %q", x.in, got, x.expected)
+		}
+	}
+}
+
+func TestGetHost(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"1.2.3.4:1234", "", "1.2.3.4"},
+		{"[::ffff:1.2.3.4]:1234", "", "1.2.3.4"},
+		{"[2001:db8:0::1]:1234", "", "2001:db8::1"},
+		{"[fe80::1%eth0]:1234", "", "fe80::1"},
+		{"127.0.0.1:1234", "5.6.7.8, 001.002.003.004", "1.2.3.4"},
+		{"127.0.0.1:1234", "::ffff:1.2.3.4", "1.2.3.4"},
+		{"127.0.0.1:1234", "garbage", ""},
+		{"nonsense", "", ""},
+	}
+	for _, x := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = x.remoteAddr
+		if len(x.forwarded) > 0 {
+			r.Header.Set("X-Forwarded-For", x.forwarded)
+		}
+		host, err := GetHost(r)
+		if host != x.expected || (err != nil) != (x.expected == "") {
+			t.Errorf("Got %q, %v for %s forwarded for %q, expected %q", host, err, x.remoteAddr, x.forwarded, x.expected)
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "file")
+
+	write := func(s string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, s)
+			return err
+		}
+	}
+	if err = writeFileAtomic(filePath, write("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeFileAtomic(filePath, write("two")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write leaves the old file, and nothing else, behind
+	failed := errors.New("failed")
+	if err = writeFileAtomic(filePath, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return failed
+	}); err != failed {
+		t.Errorf("Got %v, expected %v", err, failed)
+	}
+	if b, err := ioutil.ReadFile(filePath); err != nil || string(b) != "two" {
+		t.Errorf("Got %q, %v", b, err)
+	}
+	if info, err := os.Stat(filePath); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Got %v, %v, expected mode 0644", info.Mode(), err)
+	}
+	if infos, err := ioutil.ReadDir(dir); err != nil || len(infos) != 1 {
+		t.Errorf("Got %d files, %v, expected only the one written", len(infos), err)
+	}
+}
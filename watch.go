@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+func statFiles(paths []string) ([]os.FileInfo, error) {
+	infos := make([]os.FileInfo, len(paths))
+	for i, p := range paths {
+		info, err := os.Stat(os.ExpandEnv(p))
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = info
+	}
+	return infos, nil
+}
+
+// same file (so a rename over it counts as a change), size and mtime
+func sameFiles(a []os.FileInfo, b []os.FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !os.SameFile(a[i], b[i]) || a[i].Size() != b[i].Size() || !a[i].ModTime().Equal(b[i].ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// polls paths every interval and calls changed once a change has
+// stayed put for a whole interval, so we don't pick up a file that's
+// still being written. stops when done is closed
+func watchFiles(paths []string, interval time.Duration, done <-chan struct{}, changed func()) {
+	last, _ := statFiles(paths)
+	var pending []os.FileInfo
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := statFiles(paths)
+		if err != nil {
+			// probably mid-replace, try again next time
+			pending = nil
+			continue
+		}
+
+		switch {
+		case sameFiles(current, last):
+			pending = nil
+		case pending != nil && sameFiles(current, pending):
+			// failures aren't retried until the files change again
+			changed()
+			last, pending = current, nil
+		default:
+			pending = current
+		}
+	}
+}
+
+// polls the exit policies (and exit list, if set) and reloads them once
+// they've changed, see watchFiles. stops when done is closed
+func (e *Exits) Watch(filePath string, exitListPath string, interval time.Duration, done <-chan struct{}) {
+	paths := []string{filePath}
+	if len(exitListPath) > 0 {
+		paths = append(paths, exitListPath)
+	}
+	watchFiles(paths, interval, done, func() {
+		if err := e.Reload(filePath, exitListPath, true); err != nil {
+			log.Printf("Reloading the changed exit list failed, keeping the previous one: %v", err)
+		} else {
+			log.Println("Exit list changed on disk, updated.")
+		}
+	})
+}
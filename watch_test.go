@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policies := path.Join(dir, "exit-policies")
+
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1"}`
+	if err = ioutil.WriteFile(policies, []byte(testData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exits := new(Exits)
+	if err = exits.Reload(policies, "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		exits.Watch(policies, "", 10*time.Millisecond, done)
+		close(stopped)
+	}()
+
+	// nothing changed, nothing reloaded
+	time.Sleep(50 * time.Millisecond)
+	if g := exits.Current().Generation; g != 1 {
+		t.Errorf("Got generation %d, expected 1", g)
+	}
+
+	// replaced the way build-exits does it
+	tmp := policies + ".tmp"
+	updated := strings.Replace(testData, "111.111.111.111", "222.222.222.222", 1)
+	if err = ioutil.WriteFile(tmp, []byte(updated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(tmp, policies); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the new address", func() bool {
+		_, ok := exits.IsTor("222.222.222.222")
+		return ok
+	})
+
+	// a broken file is only tried once
+	if err = ioutil.WriteFile(policies, []byte(testData[:20]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the failed reload", func() bool {
+		return exits.ReloadStatus().Failures == 1
+	})
+	time.Sleep(50 * time.Millisecond)
+	if f := exits.ReloadStatus().Failures; f != 1 {
+		t.Errorf("Got %d failures, expected 1", f)
+	}
+	exits.assertIsTor(t, "222.222.222.222", true)
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Watch didn't stop")
+	}
+}